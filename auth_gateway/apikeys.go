@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// API keys look like "lib_<prefix>_<secret>". The prefix is stored in clear to
+// find the row; only the SHA-256 hash of the full key is kept.
+const apiKeyPrefix = "lib_"
+
+// Scopes are "<resource>:<read|write>" for the /api/<resource> routes of the
+// route table, or "*". GET requests need read, every other method needs write.
+func validScope(scope string) bool {
+	return scope == "*" || slices.Contains(apiScopes(), scope)
+}
+
+// apiScopes lists the read and write scopes of every /api/<resource> in the
+// current route table, so routes added to ROUTES_FILE can be granted without
+// a rebuild.
+func apiScopes() []string {
+	var scopes []string
+	for _, rt := range currentRoutes().routes {
+		resource, ok := strings.CutPrefix(rt.Prefix, "/api/")
+		if !ok {
+			continue
+		}
+		resource, _, _ = strings.Cut(resource, "/")
+		if resource == "" || slices.Contains(scopes, resource+":read") {
+			continue
+		}
+		scopes = append(scopes, resource+":read", resource+":write")
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// apiKeyTouchInterval limits how often last_used_at is written for a key.
+const apiKeyTouchInterval = time.Minute
+
+var (
+	apiKeyTouchMu sync.Mutex
+	apiKeyTouched = map[int64]time.Time{}
+)
+
+func generateAPIKey() (key, prefix string, err error) {
+	prefix, err = randomToken(4)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := randomToken(24)
+	if err != nil {
+		return "", "", err
+	}
+	return apiKeyPrefix + prefix + "_" + secret, prefix, nil
+}
+
+// authenticateAPIKey resolves an X-API-Key header to the claims of the key's
+// owner, restricted to the key's scopes.
+func authenticateAPIKey(ctx context.Context, key string) (*TokenClaims, error) {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return nil, fmt.Errorf("malformed API key")
+	}
+	prefix, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, fmt.Errorf("malformed API key")
+	}
+
+	claims := &TokenClaims{}
+	var keyHash, scopes string
+	var expiresAt sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT k.id, k.key_hash, k.scopes, k.expires_at, uc.user_id, uc.username, uc.role
+		FROM api_keys k JOIN user_credentials uc ON uc.user_id = k.user_id
+		WHERE k.key_prefix = $1 AND k.revoked_at IS NULL`, prefix).
+		Scan(&claims.APIKeyID, &keyHash, &scopes, &expiresAt, &claims.UserID, &claims.Username, &claims.Role)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(key)), []byte(keyHash)) != 1 {
+		return nil, fmt.Errorf("invalid API key")
+	}
+	if expiresAt.Valid && time.Now().After(expiresAt.Time) {
+		return nil, fmt.Errorf("API key expired")
+	}
+
+	claims.Scopes = strings.Split(scopes, ",")
+	touchAPIKey(claims.APIKeyID)
+	return claims, nil
+}
+
+func touchAPIKey(id int64) {
+	apiKeyTouchMu.Lock()
+	if time.Since(apiKeyTouched[id]) < apiKeyTouchInterval {
+		apiKeyTouchMu.Unlock()
+		return
+	}
+	apiKeyTouched[id] = time.Now()
+	apiKeyTouchMu.Unlock()
+
+	if _, err := db.Exec("UPDATE api_keys SET last_used_at = NOW() WHERE id = $1", id); err != nil {
+		log.Printf("Failed to record API key %d usage: %v", id, err)
+	}
+}
+
+// apiKeyAllows checks the request against the key's scopes. Only the proxied
+// /api/<resource> routes can be reached with an API key.
+func apiKeyAllows(scopes []string, method, path string) bool {
+	resource, ok := strings.CutPrefix(path, "/api/")
+	if !ok {
+		return false
+	}
+	resource, _, _ = strings.Cut(resource, "/")
+
+	access := "write"
+	if method == http.MethodGet || method == http.MethodHead {
+		access = "read"
+	}
+	required := resource + ":" + access
+	for _, scope := range scopes {
+		if scope == "*" || scope == required {
+			return true
+		}
+	}
+	return false
+}
+
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, err.Error(), "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || len(req.Scopes) == 0 {
+		sendError(w, "", "Name and scopes are required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScope(scope) {
+			sendError(w, scope, "Invalid scope", http.StatusBadRequest)
+			return
+		}
+	}
+
+	claims := requestClaims(r)
+	if req.UserID == 0 {
+		req.UserID = claims.UserID
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		sendError(w, err.Error(), "Failed to generate API key", http.StatusInternalServerError)
+		return
+	}
+
+	resp := APIKeyResponse{
+		Name:      req.Name,
+		Prefix:    prefix,
+		UserID:    req.UserID,
+		Scopes:    req.Scopes,
+		ExpiresAt: expiresAt,
+		Key:       key,
+	}
+	err = db.QueryRowContext(r.Context(), `INSERT INTO api_keys (name, key_prefix, key_hash, user_id, scopes, expires_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`,
+		req.Name, prefix, hashToken(key), req.UserID, strings.Join(req.Scopes, ","), expiresAt, claims.UserID).
+		Scan(&resp.ID, &resp.CreatedAt)
+	if err != nil {
+		sendError(w, err.Error(), "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("API key %d (%s) created by %s for user %d", resp.ID, req.Name, claims.Username, req.UserID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT id, name, key_prefix, user_id, scopes, created_at, expires_at, last_used_at, revoked_at
+		FROM api_keys ORDER BY id`)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := make([]APIKeyResponse, 0)
+	for rows.Next() {
+		var k APIKeyResponse
+		var scopes string
+		var expiresAt, lastUsedAt, revokedAt sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.UserID, &scopes, &k.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt); err != nil {
+			sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+			return
+		}
+		k.Scopes = strings.Split(scopes, ",")
+		if expiresAt.Valid {
+			k.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			k.LastUsedAt = &lastUsedAt.Time
+		}
+		if revokedAt.Valid {
+			k.RevokedAt = &revokedAt.Time
+		}
+		keys = append(keys, k)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleListAPIKeys(w, r)
+	case http.MethodPost:
+		handleCreateAPIKey(w, r)
+	default:
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		sendError(w, err.Error(), "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		sendError(w, "", "API key not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("API key %d revoked by %s", id, requestClaims(r).Username)
+	w.WriteHeader(http.StatusNoContent)
+}
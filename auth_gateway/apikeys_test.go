@@ -0,0 +1,55 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAPIKeyAllows(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		method string
+		path   string
+		want   bool
+	}{
+		{[]string{"books:read"}, "GET", "/api/books/1", true},
+		{[]string{"books:read"}, "HEAD", "/api/books/1", true},
+		{[]string{"books:read"}, "POST", "/api/books", false},
+		{[]string{"books:write"}, "DELETE", "/api/books/1", true},
+		{[]string{"books:read"}, "GET", "/api/loans", false},
+		{[]string{"*"}, "PUT", "/api/loans/1/return", true},
+		{[]string{"*"}, "GET", "/admin/users", false},
+		{[]string{"openid"}, "GET", "/api/books", false},
+	}
+	for _, tt := range tests {
+		if got := apiKeyAllows(tt.scopes, tt.method, tt.path); got != tt.want {
+			t.Errorf("apiKeyAllows(%v, %s %s) = %v, want %v", tt.scopes, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAPIScopesFollowRouteTable(t *testing.T) {
+	routes.Store(&routeTable{routes: []*route{
+		{Name: "books-v2", Prefix: "/api/books/v2"},
+		{Name: "authors", Prefix: "/api/authors"},
+		{Name: "books", Prefix: "/api/books"},
+		{Name: "docs", Prefix: "/docs"},
+	}})
+	t.Cleanup(func() { routes.Store(nil) })
+
+	want := []string{"authors:read", "authors:write", "books:read", "books:write"}
+	if got := apiScopes(); !slices.Equal(got, want) {
+		t.Errorf("apiScopes() = %v, want %v", got, want)
+	}
+	for scope, want := range map[string]bool{
+		"*":            true,
+		"authors:read": true,
+		"loans:read":   false,
+		"docs:read":    false,
+		"openid":       false,
+	} {
+		if got := validScope(scope); got != want {
+			t.Errorf("validScope(%q) = %v, want %v", scope, got, want)
+		}
+	}
+}
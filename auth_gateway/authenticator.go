@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Accounts remember which backend owns their password, so a directory login
+// can never take over a local account with the same username or vice versa.
+const (
+	AuthSourceLocal = "local"
+	AuthSourceLDAP  = "ldap"
+)
+
+// errInvalidCredentials is returned when the username or password is wrong.
+// Any other error means the backend itself failed.
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// Authenticator checks a username and password and returns the gateway
+// account they belong to.
+type Authenticator interface {
+	Name() string
+	Authenticate(username, password string) (UserCredentials, error)
+}
+
+// localAuthenticator checks the bcrypt hashes in user_credentials.
+type localAuthenticator struct{}
+
+func (localAuthenticator) Name() string { return AuthSourceLocal }
+
+func (localAuthenticator) Authenticate(username, password string) (UserCredentials, error) {
+	var creds UserCredentials
+	err := db.QueryRow("SELECT user_id, username, password_hash, role FROM user_credentials WHERE username = $1 AND auth_source = $2",
+		username, AuthSourceLocal).Scan(&creds.UserID, &creds.Username, &creds.PasswordHash, &creds.Role)
+	if err == sql.ErrNoRows {
+		return UserCredentials{}, errInvalidCredentials
+	}
+	if err != nil {
+		return UserCredentials{}, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(creds.PasswordHash), []byte(password)); err != nil {
+		return UserCredentials{}, errInvalidCredentials
+	}
+	return creds, nil
+}
+
+// chainAuthenticator tries each backend in order and returns the first
+// account that matches. If none matches but one of them failed, that failure
+// is returned so an unreachable directory is not reported as a bad password.
+type chainAuthenticator []Authenticator
+
+func (c chainAuthenticator) Name() string {
+	names := make([]string, len(c))
+	for i, a := range c {
+		names[i] = a.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (c chainAuthenticator) Authenticate(username, password string) (UserCredentials, error) {
+	var failure error
+	for _, a := range c {
+		creds, err := a.Authenticate(username, password)
+		if err == nil {
+			return creds, nil
+		}
+		if err != errInvalidCredentials {
+			log.Printf("Authentication backend %s failed: %v", a.Name(), err)
+			failure = err
+		}
+	}
+	if failure != nil {
+		return UserCredentials{}, failure
+	}
+	return UserCredentials{}, errInvalidCredentials
+}
+
+// newAuthenticator builds the backend chain from AUTH_BACKENDS, a
+// comma-separated list such as "local,ldap".
+func newAuthenticator() (Authenticator, error) {
+	var chain chainAuthenticator
+	for _, name := range strings.Split(getEnv("AUTH_BACKENDS", AuthSourceLocal), ",") {
+		switch name = strings.TrimSpace(name); name {
+		case AuthSourceLocal:
+			chain = append(chain, localAuthenticator{})
+		case AuthSourceLDAP:
+			backend, err := newLDAPAuthenticator()
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, backend)
+		default:
+			return nil, fmt.Errorf("unknown authentication backend %q", name)
+		}
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
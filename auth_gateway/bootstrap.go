@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// bootstrapAdmin gives the database its first administrator. It does nothing
+// once any admin account exists, so changing ADMIN_PASSWORD later never
+// resets a password. Without a password it only warns: the gateway still
+// serves everyone else, and the admin can be created on the next start.
+func bootstrapAdmin(username, password, email string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var adminID int64
+	err = tx.QueryRow("SELECT user_id FROM user_credentials WHERE role = 'admin' LIMIT 1").Scan(&adminID)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	if password == "" {
+		log.Println("No admin account exists; set ADMIN_PASSWORD to create one")
+		return nil
+	}
+	if errs := passwordRules.Check("password", password, username, email); len(errs) > 0 {
+		return fmt.Errorf("ADMIN_PASSWORD: %s", errs[0].Message)
+	}
+
+	var existing int64
+	err = tx.QueryRow("SELECT user_id FROM user_credentials WHERE username = $1", username).Scan(&existing)
+	if err == nil {
+		return fmt.Errorf("%s already has an account that is not an admin", username)
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	var userID int64
+	err = tx.QueryRow("SELECT id FROM users WHERE username = $1", username).Scan(&userID)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow("INSERT INTO users (username, email, first_name, last_name) VALUES ($1, $2, $3, $4) RETURNING id",
+			username, email, "Library", "Admin").Scan(&userID)
+	}
+	if err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO user_credentials (user_id, username, password_hash, role, email_verified_at)
+		VALUES ($1, $2, $3, 'admin', NOW())`, userID, username, hash)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Created admin account %s (%d)", username, userID)
+	return nil
+}
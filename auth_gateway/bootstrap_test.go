@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+func TestBootstrapAdmin(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		admin    []driver.Value // an existing admin's user_credentials row
+		account  []driver.Value // the user_credentials row holding the username
+		profile  []driver.Value // the seeded users row
+		wantErr  bool
+		created  bool
+		profiled bool
+	}{
+		{"admin exists", "Shelf-Keeper-2026", []driver.Value{int64(1)}, nil, nil, false, false, false},
+		{"no password", "", nil, nil, nil, false, false, false},
+		{"weak password", "admin", nil, nil, nil, true, false, false},
+		{"username taken", "Shelf-Keeper-2026", nil, []driver.Value{int64(3)}, nil, true, false, false},
+		{"seeded profile", "Shelf-Keeper-2026", nil, nil, []driver.Value{int64(6)}, false, true, false},
+		{"no profile", "Shelf-Keeper-2026", nil, nil, nil, false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDB{rows: []fakeRow{
+				{"WHERE role = 'admin'", tt.admin},
+				{"FROM user_credentials WHERE username", tt.account},
+				{"FROM users WHERE username", tt.profile},
+				{"INSERT INTO users", []driver.Value{int64(7)}},
+			}}
+			openFakeDB(t, fake)
+
+			err := bootstrapAdmin("admin", tt.password, "admin@example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bootstrapAdmin error = %v, want error %v", err, tt.wantErr)
+			}
+			if created := fake.ran("INSERT INTO user_credentials"); created != tt.created {
+				t.Errorf("credentials created = %v, want %v", created, tt.created)
+			}
+			if profiled := fake.ran("INSERT INTO users"); profiled != tt.profiled {
+				t.Errorf("profile created = %v, want %v", profiled, tt.profiled)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states. A closed breaker lets requests through; an open
+// one rejects them until OpenFor has passed, then lets a few trial requests
+// through half-open to decide whether to close again.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// breakerSpec configures a route's circuit breaker.
+type breakerSpec struct {
+	FailureThreshold int           `yaml:"failure_threshold"`
+	OpenFor          time.Duration `yaml:"open_for"`
+	HalfOpenRequests int           `yaml:"half_open_requests"`
+}
+
+// retrySpec configures retries of idempotent requests. Attempts counts the
+// first try; waits grow exponentially from Backoff up to MaxBackoff with full
+// jitter.
+type retrySpec struct {
+	Attempts   int           `yaml:"attempts"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+func (s *breakerSpec) applyDefaults() {
+	if s.FailureThreshold <= 0 {
+		s.FailureThreshold = 5
+	}
+	if s.OpenFor <= 0 {
+		s.OpenFor = 30 * time.Second
+	}
+	if s.HalfOpenRequests <= 0 {
+		s.HalfOpenRequests = 1
+	}
+}
+
+func (s *retrySpec) applyDefaults() {
+	if s.Attempts <= 0 {
+		s.Attempts = 3
+	}
+	if s.Backoff <= 0 {
+		s.Backoff = 100 * time.Millisecond
+	}
+	if s.MaxBackoff <= 0 {
+		s.MaxBackoff = time.Second
+	}
+}
+
+// backoff returns the jittered wait before retry number attempt (from 1).
+func (s retrySpec) backoff(attempt int) time.Duration {
+	wait := s.Backoff << (attempt - 1)
+	if wait <= 0 || wait > s.MaxBackoff {
+		wait = s.MaxBackoff
+	}
+	return rand.N(wait) + 1
+}
+
+// errBreakerOpen is returned instead of calling an upstream whose breaker is
+// open. RetryAfter tells the client when to try again.
+type errBreakerOpen struct {
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e *errBreakerOpen) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open", e.Name)
+}
+
+// circuitBreaker counts consecutive failed calls to one upstream service.
+type circuitBreaker struct {
+	name string
+	spec breakerSpec
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	trials    int // trial requests let through while half-open
+	lastError string
+}
+
+func newCircuitBreaker(name string, spec breakerSpec) *circuitBreaker {
+	spec.applyDefaults()
+	return &circuitBreaker{name: name, spec: spec, state: BreakerClosed}
+}
+
+// allow reports whether a call may go ahead. Every allowed call must be
+// followed by record, or by abandon if it never reached the upstream.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		remaining := time.Until(b.openedAt.Add(b.spec.OpenFor))
+		if remaining > 0 {
+			return &errBreakerOpen{Name: b.name, RetryAfter: remaining}
+		}
+		b.state, b.trials = BreakerHalfOpen, 0
+		log.Printf("Circuit breaker for %s is half-open", b.name)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.trials >= b.spec.HalfOpenRequests {
+			return &errBreakerOpen{Name: b.name, RetryAfter: time.Second}
+		}
+		b.trials++
+	}
+	return nil
+}
+
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.state != BreakerClosed {
+			log.Printf("Circuit breaker for %s is closed again", b.name)
+		}
+		b.state, b.failures = BreakerClosed, 0
+		return
+	}
+
+	b.failures++
+	b.lastError = err.Error()
+	if b.state == BreakerHalfOpen || b.failures >= b.spec.FailureThreshold {
+		if b.state != BreakerOpen {
+			log.Printf("Circuit breaker for %s opened after %d failures: %v", b.name, b.failures, err)
+		}
+		b.state, b.openedAt = BreakerOpen, time.Now()
+	}
+}
+
+// abandon returns the trial slot of a call that was allowed but not made,
+// so it neither closes nor reopens the breaker.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen && b.trials > 0 {
+		b.trials--
+	}
+}
+
+func (b *circuitBreaker) status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BreakerStatus{State: b.state, Failures: b.failures, LastError: b.lastError}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		s.OpenedAt = &openedAt
+	}
+	if b.state == BreakerOpen {
+		s.RetryAfter = retryAfterSeconds(time.Until(b.openedAt.Add(b.spec.OpenFor)))
+	}
+	return s
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	seconds := int((d + time.Second - 1) / time.Second)
+	return max(seconds, 1)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// errUpstreamStatus marks a 5xx answer as a failed call.
+type errUpstreamStatus int
+
+func (e errUpstreamStatus) Error() string {
+	return "upstream answered " + strconv.Itoa(int(e))
+}
+
+// do sends a request built by newRequest to one of the route's upstreams,
+// guarded by the route's breaker. Idempotent requests are retried on
+// transport errors and 502, 503 and 504 answers. The last answer is
+// returned even if it is a 5xx.
+func (rt *route) do(ctx context.Context, idempotent bool, newRequest func(target *url.URL) (*http.Request, error)) (*http.Response, error) {
+	attempts := 1
+	if idempotent {
+		attempts = rt.retry.Attempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := rt.breaker.allow(); err != nil {
+			return nil, err
+		}
+		target, err := rt.pool.acquire()
+		if err != nil {
+			rt.breaker.record(err)
+			return nil, err
+		}
+
+		req, err := newRequest(target.URL)
+		if err != nil {
+			rt.pool.release(target, false)
+			rt.breaker.abandon()
+			return nil, err
+		}
+		resp, err := rt.client.Do(req.WithContext(ctx))
+		if err != nil && ctx.Err() != nil {
+			// The client went away; that says nothing about the upstream.
+			rt.pool.release(target, false)
+			rt.breaker.abandon()
+			return nil, err
+		}
+		callErr := err
+		if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+			callErr = errUpstreamStatus(resp.StatusCode)
+		}
+		rt.pool.release(target, callErr != nil)
+		rt.breaker.record(callErr)
+
+		retryable := err != nil || resp.StatusCode == http.StatusBadGateway ||
+			resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+		if !retryable || attempt >= attempts {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(rt.retry.backoff(attempt)):
+		}
+	}
+}
+
+// sendUpstreamError answers for a call to a service that failed. Calls
+// rejected by an open breaker or with no healthy instance fail fast with 503.
+func sendUpstreamError(w http.ResponseWriter, err error, message string) {
+	var open *errBreakerOpen
+	var unhealthy *errNoHealthyUpstream
+	switch {
+	case errors.As(err, &open):
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(open.RetryAfter)))
+		sendError(w, err.Error(), "Service unavailable", http.StatusServiceUnavailable)
+	case errors.As(err, &unhealthy):
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(unhealthy.RetryAfter)))
+		sendError(w, err.Error(), "Service unavailable", http.StatusServiceUnavailable)
+	default:
+		sendError(w, err.Error(), message, http.StatusBadGateway)
+	}
+}
+
+// handleListBreakers shows the breaker and instance state of every route.
+func handleListBreakers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := make([]BreakerStatus, 0)
+	for _, rt := range currentRoutes().routes {
+		s := rt.breaker.status()
+		s.Route = rt.Name
+		s.Upstreams = rt.pool.status()
+		statuses = append(statuses, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
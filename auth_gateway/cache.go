@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheEntries = 1000
+	// Larger answers are passed through without being cached.
+	maxCachedBodySize = 1 << 20
+)
+
+// cachedHeaders are the upstream headers stored with a cached answer. Headers
+// set by the gateway itself, such as X-Request-ID and RateLimit-*, belong to
+// a single request and are not replayed.
+var cachedHeaders = []string{"Content-Type", "Content-Language", "Cache-Control", "ETag", "Last-Modified"}
+
+// cacheSpec configures a route's response cache. GET answers are kept for
+// TTL unless the upstream's Cache-Control says otherwise. A write to the
+// route, or to one of the routes in InvalidatedBy, empties it.
+type cacheSpec struct {
+	TTL           time.Duration `yaml:"ttl"`
+	MaxEntries    int           `yaml:"max_entries"`
+	InvalidatedBy []string      `yaml:"invalidated_by"`
+}
+
+// responseCache is an LRU of GET answers keyed by request URI. It is shared
+// by every caller of the route, so only enable it for routes whose answers do
+// not depend on who asks; access rules still run before it.
+type responseCache struct {
+	spec cacheSpec
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+}
+
+type cacheEntry struct {
+	key      string
+	status   int
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+	expires  time.Time
+}
+
+func newResponseCache(spec cacheSpec) *responseCache {
+	if spec.MaxEntries <= 0 {
+		spec.MaxEntries = defaultCacheEntries
+	}
+	return &responseCache{spec: spec, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (c *responseCache) get(key string, now time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+func (c *responseCache) put(e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.lru.Remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.spec.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+}
+
+// invalidate empties the caches that a write to the named route affects.
+func (t *routeTable) invalidate(name string) {
+	for _, rt := range t.routes {
+		if rt.cache != nil && (rt.Name == name || contains(rt.cache.spec.InvalidatedBy, name)) {
+			rt.cache.flush()
+		}
+	}
+}
+
+// cached serves GET requests from the route's cache and invalidates caches
+// after writes. Answers carry an ETag, so clients can revalidate with
+// If-None-Match and get 304 Not Modified.
+func (rt *route) cached(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next(w, r)
+			currentRoutes().invalidate(rt.Name)
+			return
+		}
+		requestDirectives := parseCacheControl(r.Header.Get("Cache-Control"))
+		_, noStore := requestDirectives["no-store"]
+		if rt.cache == nil || r.Method != http.MethodGet || noStore {
+			next(w, r)
+			return
+		}
+
+		key := r.URL.RequestURI()
+		now := time.Now()
+		_, noCache := requestDirectives["no-cache"]
+		if !noCache && r.Header.Get("Pragma") != "no-cache" {
+			if e := rt.cache.get(key, now); e != nil {
+				w.Header().Set("X-Cache", "HIT")
+				w.Header().Set("Age", strconv.Itoa(int(now.Sub(e.storedAt).Seconds())))
+				writeCachedResponse(w, r, e.status, e.header, e.body)
+				return
+			}
+		}
+
+		rec := &cacheRecorder{w: w, status: http.StatusOK}
+		w.Header().Set("X-Cache", "MISS")
+		// The CORS handler adds Vary: Origin to every answer; only a Vary
+		// from the upstream matters here.
+		varyBefore := len(w.Header().Values("Vary"))
+		next(rec, r)
+		if rec.passthrough {
+			return
+		}
+		varies := len(w.Header().Values("Vary")) > varyBefore
+
+		header := http.Header{}
+		for _, h := range cachedHeaders {
+			if v := w.Header().Values(h); len(v) > 0 {
+				header[h] = v
+			}
+		}
+		if header.Get("ETag") == "" && rec.status == http.StatusOK {
+			sum := sha256.Sum256(rec.body.Bytes())
+			header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		}
+		if header.Get("Cache-Control") == "" {
+			// Clients revalidate every time; the gateway answers from its
+			// cache, so a 304 is cheap.
+			header.Set("Cache-Control", "private, no-cache")
+		}
+
+		if ttl, ok := cacheTTL(rt.cache.spec.TTL, rec.status, w.Header().Get("Cache-Control"), varies); ok {
+			rt.cache.put(&cacheEntry{
+				key:      key,
+				status:   rec.status,
+				header:   header,
+				body:     rec.body.Bytes(),
+				storedAt: now,
+				expires:  now.Add(ttl),
+			})
+		}
+		writeCachedResponse(w, r, rec.status, header, rec.body.Bytes())
+	}
+}
+
+// cacheTTL decides whether an answer may be stored and for how long. Only
+// 200 answers are cached; the upstream's s-maxage or max-age wins over the
+// route's TTL. Answers that vary by request header are not cached.
+func cacheTTL(routeTTL time.Duration, status int, cacheControl string, varies bool) (time.Duration, bool) {
+	if status != http.StatusOK || varies {
+		return 0, false
+	}
+	directives := parseCacheControl(cacheControl)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return 0, false
+		}
+	}
+	ttl := routeTTL
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[d]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil {
+				return 0, false
+			}
+			ttl = time.Duration(seconds) * time.Second
+			break
+		}
+	}
+	return ttl, ttl > 0
+}
+
+func parseCacheControl(value string) map[string]string {
+	directives := map[string]string{}
+	for _, part := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+// writeCachedResponse sends an answer, or 304 if it is a 200 whose ETag the
+// client already has.
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, status int, header http.Header, body []byte) {
+	for h, v := range header {
+		w.Header()[h] = v
+	}
+	if status == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), header.Get("ETag")) {
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// etagMatches applies the weak comparison If-None-Match calls for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheRecorder holds back an answer so it can be stored and turned into a
+// 304. Answers too large to cache are written through as they come.
+type cacheRecorder struct {
+	w           http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	passthrough bool
+}
+
+func (c *cacheRecorder) Header() http.Header {
+	return c.w.Header()
+}
+
+func (c *cacheRecorder) WriteHeader(status int) {
+	if c.passthrough {
+		return
+	}
+	c.status = status
+}
+
+func (c *cacheRecorder) Write(b []byte) (int, error) {
+	if c.passthrough {
+		return c.w.Write(b)
+	}
+	if c.body.Len()+len(b) <= maxCachedBodySize {
+		return c.body.Write(b)
+	}
+	c.passthrough = true
+	c.w.Header().Set("X-Cache", "BYPASS")
+	c.w.WriteHeader(c.status)
+	if _, err := c.w.Write(c.body.Bytes()); err != nil {
+		return 0, err
+	}
+	c.body.Reset()
+	return c.w.Write(b)
+}
+
+// Flush only reaches the client once the answer is written through; a held
+// back answer goes out in one piece when it is complete.
+func (c *cacheRecorder) Flush() {
+	if c.passthrough {
+		http.NewResponseController(c.w).Flush()
+	}
+}
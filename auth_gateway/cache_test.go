@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachedRevalidationAndInvalidation(t *testing.T) {
+	books := &route{Name: "books", cache: newResponseCache(cacheSpec{TTL: time.Minute, InvalidatedBy: []string{"loans"}})}
+	loans := &route{Name: "loans"}
+	routes.Store(&routeTable{routes: []*route{books, loans}})
+	t.Cleanup(func() { routes.Store(nil) })
+
+	calls := 0
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[{"id":1}]`))
+		}
+	}
+	booksHandler, loansHandler := books.cached(upstream), loans.cached(upstream)
+
+	// Steps run in order against the same cache. {etag} stands for the ETag
+	// of the first answer.
+	steps := []struct {
+		name       string
+		handler    http.HandlerFunc
+		method     string
+		header     string
+		wantStatus int
+		wantCache  string
+		wantCalls  int
+	}{
+		{"first read", booksHandler, "GET", "", http.StatusOK, "MISS", 1},
+		{"second read", booksHandler, "GET", "", http.StatusOK, "HIT", 1},
+		{"revalidation", booksHandler, "GET", "If-None-Match: {etag}", http.StatusNotModified, "HIT", 1},
+		{"weak revalidation", booksHandler, "GET", "If-None-Match: W/{etag}", http.StatusNotModified, "HIT", 1},
+		{"any revalidation", booksHandler, "GET", "If-None-Match: *", http.StatusNotModified, "HIT", 1},
+		{"stale ETag", booksHandler, "GET", `If-None-Match: "other"`, http.StatusOK, "HIT", 1},
+		{"no-cache request", booksHandler, "GET", "Cache-Control: no-cache", http.StatusOK, "MISS", 2},
+		{"no-cache request is stored", booksHandler, "GET", "", http.StatusOK, "HIT", 2},
+		{"write to the route", booksHandler, "POST", "", http.StatusOK, "", 3},
+		{"read after the write", booksHandler, "GET", "If-None-Match: {etag}", http.StatusNotModified, "MISS", 4},
+		{"write to an invalidating route", loansHandler, "POST", "", http.StatusOK, "", 5},
+		{"read after the loan", booksHandler, "GET", "", http.StatusOK, "MISS", 6},
+		{"read from an uncached route", loansHandler, "GET", "", http.StatusOK, "", 7},
+	}
+
+	etag := ""
+	for _, step := range steps {
+		req := httptest.NewRequest(step.method, "/api/books?page=1", nil)
+		if name, value, ok := strings.Cut(step.header, ": "); ok {
+			req.Header.Set(name, strings.ReplaceAll(value, "{etag}", etag))
+		}
+		rec := httptest.NewRecorder()
+		step.handler(rec, req)
+
+		if rec.Code != step.wantStatus {
+			t.Errorf("%s: status %d, want %d", step.name, rec.Code, step.wantStatus)
+		}
+		if got := rec.Header().Get("X-Cache"); got != step.wantCache {
+			t.Errorf("%s: X-Cache %q, want %q", step.name, got, step.wantCache)
+		}
+		if calls != step.wantCalls {
+			t.Errorf("%s: %d upstream calls, want %d", step.name, calls, step.wantCalls)
+		}
+		if rec.Code == http.StatusNotModified && rec.Body.Len() > 0 {
+			t.Errorf("%s: 304 with a body", step.name)
+		}
+		if etag == "" {
+			if etag = rec.Header().Get("ETag"); etag == "" {
+				t.Fatalf("%s: no ETag", step.name)
+			}
+		}
+	}
+}
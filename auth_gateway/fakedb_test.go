@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// fakeDB is a database/sql connector for testing code written against
+// Postgres. A query gets the row of the first entry in rows whose fragment
+// it contains, or no rows. Statements are recorded once their transaction
+// commits, so a rolled back transaction leaves no trace.
+type fakeDB struct {
+	rows     []fakeRow
+	executed []string
+}
+
+type fakeRow struct {
+	fragment string
+	values   []driver.Value
+}
+
+// openFakeDB installs f as db for the rest of the test.
+func openFakeDB(t *testing.T, f *fakeDB) {
+	t.Helper()
+	db = sql.OpenDB(f)
+	t.Cleanup(func() {
+		db.Close()
+		db = nil
+	})
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+// ran reports whether a committed statement contains fragment.
+func (f *fakeDB) ran(fragment string) bool {
+	for _, q := range f.executed {
+		if strings.Contains(q, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+type fakeConn struct {
+	db      *fakeDB
+	inTx    bool
+	pending []string
+}
+
+func (c *fakeConn) record(query string) {
+	if c.inTx {
+		c.pending = append(c.pending, query)
+	} else {
+		c.db.executed = append(c.db.executed, query)
+	}
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.inTx, c.pending = true, nil
+	return fakeTx{c}, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.record(query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.record(query)
+	for _, row := range c.db.rows {
+		if strings.Contains(query, row.fragment) {
+			return &fakeRows{values: row.values}, nil
+		}
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeTx struct{ c *fakeConn }
+
+func (t fakeTx) Commit() error {
+	t.c.db.executed = append(t.c.db.executed, t.c.pending...)
+	t.c.inTx, t.c.pending = false, nil
+	return nil
+}
+
+func (t fakeTx) Rollback() error {
+	t.c.inTx, t.c.pending = false, nil
+	return nil
+}
+
+type fakeRows struct{ values []driver.Value }
+
+func (r *fakeRows) Columns() []string { return make([]string, len(r.values)) }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.values == nil {
+		return io.EOF
+	}
+	copy(dest, r.values)
+	r.values = nil
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health states reported by /readyz, /status and the services.
+const (
+	HealthOK          = "ok"
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+)
+
+const (
+	healthCheckTimeout = 2 * time.Second
+	// Every service answers readiness probes on this path.
+	serviceReadyzPath = "/readyz"
+)
+
+var statusClient = &http.Client{Timeout: healthCheckTimeout}
+
+// statusCacheTTL bounds how often /status fans out to every upstream, however
+// many callers poll it.
+const statusCacheTTL = 5 * time.Second
+
+var statusCache struct {
+	mu      sync.Mutex
+	resp    StatusResponse
+	expires time.Time
+}
+
+// handleHealthz is the liveness probe: the process is up and serving.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeHealth(w, HealthResponse{Status: HealthOK}, http.StatusOK)
+}
+
+// handleReadyz is the readiness probe. Only the database is required: the
+// gateway still serves logins and the other routes while one service is
+// down, so that shows in /status instead.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	database := checkDatabase(r.Context())
+	resp := HealthResponse{Status: database.Status, Checks: map[string]CheckResult{"database": database}}
+	status := http.StatusOK
+	if resp.Status != HealthOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, resp, status)
+}
+
+// handleStatus reports the state of the database and of every route. It
+// answers 200 only when everything is ok. Results are shared for
+// statusCacheTTL; callers arriving during a check wait for it.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statusCache.mu.Lock()
+	if time.Now().After(statusCache.expires) {
+		// The result is shared, so the caller leaving must not cut it short.
+		statusCache.resp = checkStatus(r.WithContext(context.WithoutCancel(r.Context())))
+		statusCache.expires = time.Now().Add(statusCacheTTL)
+	}
+	resp := statusCache.resp
+	statusCache.mu.Unlock()
+
+	status := http.StatusOK
+	if resp.Status != HealthOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// checkStatus checks the database and the readiness of every instance of
+// every route in parallel.
+func checkStatus(r *http.Request) StatusResponse {
+	resp := StatusResponse{CheckedAt: time.Now().UTC(), Services: []ServiceStatus{}}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resp.Database = checkDatabase(r.Context())
+	}()
+	for _, rt := range currentRoutes().routes {
+		s := ServiceStatus{Route: rt.Name, Breaker: rt.breaker.status().State}
+		s.Upstreams = make([]UpstreamCheck, len(rt.pool.targets))
+		for i, t := range rt.pool.targets {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.Upstreams[i] = checkUpstream(r, t.URL.String())
+			}()
+		}
+		resp.Services = append(resp.Services, s)
+	}
+	wg.Wait()
+
+	resp.Status = HealthOK
+	if resp.Database.Status != HealthOK {
+		resp.Status = HealthUnavailable
+	}
+	for i := range resp.Services {
+		s := &resp.Services[i]
+		s.Status = serviceHealth(s)
+		if s.Status != HealthOK && resp.Status == HealthOK {
+			resp.Status = HealthDegraded
+		}
+	}
+	return resp
+}
+
+// serviceHealth is ok when every instance is ready, unavailable when none is
+// or the breaker is open, and degraded in between.
+func serviceHealth(s *ServiceStatus) string {
+	ready := 0
+	for _, u := range s.Upstreams {
+		if u.Status == HealthOK {
+			ready++
+		}
+	}
+	switch {
+	case ready == 0 || s.Breaker == BreakerOpen:
+		return HealthUnavailable
+	case ready < len(s.Upstreams):
+		return HealthDegraded
+	default:
+		return HealthOK
+	}
+}
+
+func checkDatabase(ctx context.Context) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := db.PingContext(ctx)
+	result := CheckResult{Status: HealthOK, LatencyMs: millisecondsSince(start)}
+	if err != nil {
+		result.Status, result.Error = HealthUnavailable, err.Error()
+	}
+	return result
+}
+
+// checkUpstream asks one service instance whether it is ready and keeps the
+// checks it reports.
+func checkUpstream(in *http.Request, base string) UpstreamCheck {
+	check := UpstreamCheck{URL: base, Status: HealthUnavailable}
+	start := time.Now()
+	req, err := http.NewRequestWithContext(in.Context(), http.MethodGet, base+serviceReadyzPath, nil)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	req.Header.Set(HeaderRequestID, requestID(in))
+	resp, err := statusClient.Do(req)
+	check.LatencyMs = millisecondsSince(start)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	defer resp.Body.Close()
+
+	var health HealthResponse
+	json.NewDecoder(resp.Body).Decode(&health)
+	check.Checks = health.Checks
+	if resp.StatusCode != http.StatusOK {
+		check.Error = fmt.Sprintf("HTTP %d", resp.StatusCode)
+		return check
+	}
+	check.Status = HealthOK
+	return check
+}
+
+func millisecondsSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+func writeHealth(w http.ResponseWriter, resp HealthResponse, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// isProbePath reports whether path is polled by orchestration or monitoring
+// rather than called by clients.
+func isProbePath(path string) bool {
+	switch path {
+	case "/healthz", "/readyz", "/status":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServiceHealth(t *testing.T) {
+	ok := UpstreamCheck{Status: HealthOK}
+	down := UpstreamCheck{Status: HealthUnavailable}
+	tests := []struct {
+		name      string
+		breaker   string
+		upstreams []UpstreamCheck
+		want      string
+	}{
+		{"all ready", BreakerClosed, []UpstreamCheck{ok, ok}, HealthOK},
+		{"one down", BreakerClosed, []UpstreamCheck{ok, down}, HealthDegraded},
+		{"all down", BreakerClosed, []UpstreamCheck{down, down}, HealthUnavailable},
+		{"breaker open", BreakerOpen, []UpstreamCheck{ok, ok}, HealthUnavailable},
+		{"breaker half open", BreakerHalfOpen, []UpstreamCheck{ok}, HealthOK},
+	}
+	for _, tt := range tests {
+		s := &ServiceStatus{Breaker: tt.breaker, Upstreams: tt.upstreams}
+		if got := serviceHealth(s); got != tt.want {
+			t.Errorf("%s: serviceHealth = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	openFakeDB(t, &fakeDB{})
+	ready := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != serviceReadyzPath {
+			http.NotFound(w, r)
+			return
+		}
+		writeHealth(w, HealthResponse{Status: HealthOK}, http.StatusOK)
+	}))
+	defer ready.Close()
+	notReady := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, HealthResponse{
+			Status: HealthUnavailable,
+			Checks: map[string]CheckResult{"database": {Status: HealthUnavailable, Error: "connection refused"}},
+		}, http.StatusServiceUnavailable)
+	}))
+	defer notReady.Close()
+
+	path := writeRoutes(t, fmt.Sprintf(`
+routes:
+  - {name: books, prefix: /api/books, upstreams: [%[1]s, %[1]s]}
+  - {name: users, prefix: /api/users, upstreams: [%[1]s, %[2]s]}
+  - {name: loans, prefix: /api/loans, upstreams: [%[2]s]}`, ready.URL, notReady.URL))
+	if err := loadRoutes(path); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := checkStatus(httptest.NewRequest(http.MethodGet, "/status", nil))
+	if resp.Database.Status != HealthOK {
+		t.Errorf("database = %+v, want ok", resp.Database)
+	}
+	if resp.Status != HealthDegraded {
+		t.Errorf("status = %s, want %s", resp.Status, HealthDegraded)
+	}
+	want := map[string]string{"books": HealthOK, "users": HealthDegraded, "loans": HealthUnavailable}
+	for _, s := range resp.Services {
+		if s.Status != want[s.Route] {
+			t.Errorf("%s = %s, want %s", s.Route, s.Status, want[s.Route])
+		}
+	}
+
+	loans := resp.Services[len(resp.Services)-1].Upstreams[0]
+	if loans.Error != "HTTP 503" || loans.Checks["database"].Status != HealthUnavailable {
+		t.Errorf("loans upstream = %+v, want the instance's own checks and HTTP 503", loans)
+	}
+}
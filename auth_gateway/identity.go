@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"identity"
+)
+
+// Headers the gateway sets on requests to services. The identity headers are
+// signed with IDENTITY_SIGNING_KEY so a service can tell them from headers
+// a client made up; the identity module holds the protocol both sides use.
+const (
+	HeaderRequestID         = identity.HeaderRequestID
+	HeaderUserID            = identity.HeaderUserID
+	HeaderUserName          = identity.HeaderUserName
+	HeaderUserRoles         = identity.HeaderUserRoles
+	HeaderIdentityTimestamp = identity.HeaderIdentityTimestamp
+	HeaderIdentitySignature = identity.HeaderIdentitySignature
+)
+
+const (
+	requestIDContextKey contextKey = "requestID"
+	maxRequestIDLength             = 128
+)
+
+var identitySigningKey []byte
+
+func loadIdentityConfig() {
+	identitySigningKey = []byte(getEnv("IDENTITY_SIGNING_KEY", ""))
+	if len(identitySigningKey) == 0 {
+		log.Println("IDENTITY_SIGNING_KEY is not set, services cannot verify caller identity")
+	}
+}
+
+// requestIDMiddleware gives every request an ID and echoes it in the
+// response. A well-formed X-Request-ID from the client is kept so calls can
+// be followed across systems.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if !validRequestID(id) {
+			var err error
+			if id, err = randomToken(16); err != nil {
+				sendError(w, err.Error(), "Failed to generate request ID", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set(HeaderRequestID, id)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("request.id", id))
+		ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// forwardHeaders sets the request ID, the X-Forwarded-* headers and the
+// signed identity of the caller on out, a request to a service made on
+// behalf of in. Identity headers on out are always replaced, so a client
+// cannot pass its own.
+func forwardHeaders(out, in *http.Request) {
+	out.Header.Set(HeaderRequestID, requestID(in))
+
+	remote, _, err := net.SplitHostPort(in.RemoteAddr)
+	if err != nil {
+		remote = in.RemoteAddr
+	}
+	forwardedFor, proto := remote, "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	if trustForwardedFor {
+		if prior := in.Header.Get("X-Forwarded-For"); prior != "" {
+			forwardedFor = prior + ", " + remote
+		}
+		if p := in.Header.Get("X-Forwarded-Proto"); p != "" {
+			proto = p
+		}
+	}
+	out.Header.Set("X-Forwarded-For", forwardedFor)
+	out.Header.Set("X-Forwarded-Host", in.Host)
+	out.Header.Set("X-Forwarded-Proto", proto)
+
+	for _, h := range identity.Headers {
+		out.Header.Del(h)
+	}
+	claims := requestClaims(in)
+	if claims == nil || claims.Username == "" {
+		return
+	}
+	userID := ""
+	if claims.UserID != 0 {
+		userID = strconv.FormatInt(claims.UserID, 10)
+	}
+	out.Header.Set(HeaderUserID, userID)
+	out.Header.Set(HeaderUserName, claims.Username)
+	out.Header.Set(HeaderUserRoles, claims.Role)
+	signIdentity(out)
+}
+
+// signIdentity stamps and signs the identity headers of out. It must run
+// again whenever the method, path or query of out changes.
+func signIdentity(out *http.Request) {
+	identity.Sign(out, identitySigningKey)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Every token signed by the gateway carries a typ claim so that tokens issued
+// for one purpose cannot be replayed for another.
+const (
+	TokenTypeAccess      = "access"
+	TokenTypeMFA         = "mfa"
+	TokenTypeID          = "id"
+	TokenTypeEmailVerify = "email_verify"
+)
+
+// signingKey is one private key from the key directory. The key ID is the
+// file name without the .pem extension.
+type signingKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	Private   crypto.PrivateKey
+	Public    crypto.PublicKey
+	CreatedAt time.Time
+}
+
+// keyCreatedHeader is the PEM header that records when a key was generated.
+// Copying or restoring the key directory changes file times, so they cannot
+// be trusted for retention.
+const keyCreatedHeader = "Created"
+
+// keyRing holds every key that may still verify tokens. The newest key signs
+// new tokens; older ones stay available until the retention period ends.
+type keyRing struct {
+	dir       string
+	alg       string
+	rotation  time.Duration
+	retention time.Duration
+
+	mu     sync.RWMutex
+	keys   map[string]*signingKey
+	active *signingKey
+}
+
+// newKeyRing checks the key settings. A rotation of zero never rotates. Keys
+// are retained for longer than the rotation interval, so the previous key
+// still verifies the tokens it signed after the next one takes over.
+func newKeyRing(dir, alg string, rotation, retention time.Duration) (*keyRing, error) {
+	if alg != "RS256" && alg != "EdDSA" {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if rotation < 0 || retention < 0 {
+		return nil, fmt.Errorf("key rotation and retention must be positive")
+	}
+	if rotation > 0 && retention <= rotation {
+		return nil, fmt.Errorf("key retention %s must be longer than the rotation interval %s", retention, rotation)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &keyRing{dir: dir, alg: alg, rotation: rotation, retention: retention, keys: map[string]*signingKey{}}, nil
+}
+
+// Load reads every PEM file in the key directory, drops keys past their
+// retention and generates a first key if none are left. The newest key is
+// active and never dropped, however old it is.
+func (k *keyRing) Load() error {
+	paths, err := filepath.Glob(filepath.Join(k.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]*signingKey{}
+	files := map[string]string{}
+	var active *signingKey
+	for _, path := range paths {
+		key, err := loadSigningKey(path)
+		if err != nil {
+			log.Printf("Skipping key %s: %v", path, err)
+			continue
+		}
+		keys[key.ID] = key
+		files[key.ID] = path
+		if active == nil || key.CreatedAt.After(active.CreatedAt) {
+			active = key
+		}
+	}
+	for id, key := range keys {
+		if key == active || time.Since(key.CreatedAt) <= k.retention {
+			continue
+		}
+		if err := os.Remove(files[id]); err != nil {
+			log.Printf("Failed to remove retired key %s: %v", files[id], err)
+		}
+		delete(keys, id)
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.active = active
+	k.mu.Unlock()
+
+	if active == nil {
+		return k.Rotate()
+	}
+	return nil
+}
+
+// Rotate generates a new key, writes it to the key directory and makes it the
+// active signing key.
+func (k *keyRing) Rotate() error {
+	var private crypto.PrivateKey
+	var method jwt.SigningMethod
+	switch k.alg {
+	case "EdDSA":
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		private, method = priv, jwt.SigningMethodEdDSA
+	default:
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		private, method = priv, jwt.SigningMethodRS256
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+
+	suffix, err := randomToken(4)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	id := now.UTC().Format("20060102T150405") + "-" + suffix
+	path := filepath.Join(k.dir, id+".pem")
+	block := &pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{keyCreatedHeader: now.UTC().Format(time.RFC3339Nano)},
+		Bytes:   der,
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+
+	key := &signingKey{
+		ID:        id,
+		Method:    method,
+		Private:   private,
+		Public:    private.(crypto.Signer).Public(),
+		CreatedAt: now,
+	}
+
+	k.mu.Lock()
+	k.keys[id] = key
+	k.active = key
+	k.mu.Unlock()
+
+	log.Printf("Generated new %s signing key %s", k.alg, id)
+	return nil
+}
+
+// Schedule reloads the key directory every minute, picking up keys written by
+// other replicas, and rotates once the active key is older than the rotation
+// interval.
+func (k *keyRing) Schedule() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := k.Load(); err != nil {
+			log.Printf("Failed to reload signing keys: %v", err)
+			continue
+		}
+		if k.rotation > 0 && time.Since(k.Active().CreatedAt) >= k.rotation {
+			if err := k.Rotate(); err != nil {
+				log.Printf("Failed to rotate signing key: %v", err)
+			}
+		}
+	}
+}
+
+func (k *keyRing) Active() *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+func (k *keyRing) Lookup(id string) *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[id]
+}
+
+func (k *keyRing) All() []*signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make([]*signingKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys
+}
+
+func loadSigningKey(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{
+		ID:        strings.TrimSuffix(filepath.Base(path), ".pem"),
+		Private:   private,
+		CreatedAt: info.ModTime(),
+	}
+	// Keys written before the header existed fall back to the file time.
+	if created, ok := block.Headers[keyCreatedHeader]; ok {
+		key.CreatedAt, err = time.Parse(time.RFC3339Nano, created)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s header: %w", keyCreatedHeader, err)
+		}
+	}
+	switch priv := private.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, priv.Public()
+	case ed25519.PrivateKey:
+		key.Method, key.Public = jwt.SigningMethodEdDSA, priv.Public()
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+	return key, nil
+}
+
+// signJWT signs claims with the active key and sets the kid header.
+func signJWT(claims jwt.MapClaims) (string, error) {
+	key := signingKeys.Active()
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// parseJWT verifies a token against the key named by its kid header.
+func parseJWT(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key := signingKeys.Lookup(kid)
+		if key == nil {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method")
+		}
+		return key.Public, nil
+	}, jwt.WithValidMethods([]string{"RS256", "EdDSA"}))
+}
+
+func jwkFromKey(key *signingKey) JWK {
+	jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+	return jwk
+}
+
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range signingKeys.All() {
+		set.Keys = append(set.Keys, jwkFromKey(key))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewKeyRingChecksRetention(t *testing.T) {
+	tests := []struct {
+		rotation, retention time.Duration
+		ok                  bool
+	}{
+		{24 * time.Hour, 48 * time.Hour, true},
+		{0, 0, true},
+		{24 * time.Hour, 24 * time.Hour, false},
+		{24 * time.Hour, time.Hour, false},
+		{-time.Hour, time.Hour, false},
+	}
+	for _, tt := range tests {
+		_, err := newKeyRing(t.TempDir(), "EdDSA", tt.rotation, tt.retention)
+		if (err == nil) != tt.ok {
+			t.Errorf("newKeyRing(rotation %s, retention %s) error = %v, want ok %v", tt.rotation, tt.retention, err, tt.ok)
+		}
+	}
+}
+
+func TestKeyRingLoadKeepsActiveKey(t *testing.T) {
+	dir := t.TempDir()
+	ring, err := newKeyRing(dir, "EdDSA", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	active := ring.Active()
+
+	// A zero retention retires every key at once, except the active one.
+	for i := 0; i < 3; i++ {
+		if err := ring.Load(); err != nil {
+			t.Fatal(err)
+		}
+		if got := ring.Active(); got.ID != active.ID {
+			t.Fatalf("load %d replaced active key %s with %s", i, active.ID, got.ID)
+		}
+	}
+}
+
+func TestKeyRingUsesCreatedHeader(t *testing.T) {
+	dir := t.TempDir()
+	ring, err := newKeyRing(dir, "EdDSA", time.Hour, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	old := ring.Active()
+	if err := ring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restoring a backup makes the old key look new on disk; its header
+	// still says when it was made.
+	path := filepath.Join(dir, old.ID+".pem")
+	key, err := loadSigningKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.CreatedAt.Equal(old.CreatedAt) {
+		t.Fatalf("CreatedAt = %s, want %s", key.CreatedAt, old.CreatedAt)
+	}
+	if err := os.Chtimes(path, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if key, err = loadSigningKey(path); err != nil || !key.CreatedAt.Equal(old.CreatedAt) {
+		t.Fatalf("CreatedAt after touching the file = %v, %v, want %s", key.CreatedAt, err, old.CreatedAt)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// rolePriority decides which role wins when a directory user belongs to
+// several mapped groups.
+var rolePriority = map[string]int{
+	RolePatron:    0,
+	RoleLibrarian: 1,
+	RoleAdmin:     2,
+}
+
+// ldapAuthenticator binds to a directory as the user to check the password.
+// Users are looked up with a service account, then created or updated in
+// users and user_credentials on every successful login.
+type ldapAuthenticator struct {
+	url          string
+	startTLS     bool
+	insecureTLS  bool
+	timeout      time.Duration
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	userFilter   string
+	groupBaseDN  string
+	groupFilter  string
+	groupAttr    string
+	roleMap      map[string]string
+	defaultRole  string
+}
+
+func newLDAPAuthenticator() (*ldapAuthenticator, error) {
+	a := &ldapAuthenticator{
+		url:          getEnv("LDAP_URL", "ldap://localhost:389"),
+		startTLS:     getEnv("LDAP_START_TLS", "false") == "true",
+		insecureTLS:  getEnv("LDAP_TLS_INSECURE_SKIP_VERIFY", "false") == "true",
+		timeout:      getEnvDuration("LDAP_TIMEOUT", 5*time.Second),
+		bindDN:       getEnv("LDAP_BIND_DN", ""),
+		bindPassword: getEnv("LDAP_BIND_PASSWORD", ""),
+		baseDN:       getEnv("LDAP_BASE_DN", ""),
+		userFilter:   getEnv("LDAP_USER_FILTER", "(uid=%s)"),
+		groupFilter:  getEnv("LDAP_GROUP_FILTER", "(member=%s)"),
+		groupAttr:    getEnv("LDAP_GROUP_NAME_ATTRIBUTE", "cn"),
+		defaultRole:  getEnv("LDAP_DEFAULT_ROLE", RolePatron),
+		roleMap:      map[string]string{},
+	}
+	a.groupBaseDN = getEnv("LDAP_GROUP_BASE_DN", a.baseDN)
+
+	if a.baseDN == "" {
+		return nil, fmt.Errorf("LDAP_BASE_DN is required for the ldap backend")
+	}
+	if !strings.Contains(a.userFilter, "%s") || !strings.Contains(a.groupFilter, "%s") {
+		return nil, fmt.Errorf("LDAP_USER_FILTER and LDAP_GROUP_FILTER must contain %%s")
+	}
+	if !validRoles[a.defaultRole] {
+		return nil, fmt.Errorf("invalid LDAP_DEFAULT_ROLE %q", a.defaultRole)
+	}
+
+	// LDAP_ROLE_MAP is a comma-separated list of group:role pairs, e.g.
+	// "library-staff:librarian,library-admins:admin".
+	for _, pair := range strings.Split(getEnv("LDAP_ROLE_MAP", ""), ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, ":")
+		if !ok || !validRoles[role] {
+			return nil, fmt.Errorf("invalid LDAP_ROLE_MAP entry %q", pair)
+		}
+		a.roleMap[strings.ToLower(group)] = role
+	}
+	return a, nil
+}
+
+func (a *ldapAuthenticator) Name() string { return AuthSourceLDAP }
+
+func (a *ldapAuthenticator) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.insecureTLS}
+	conn, err := ldap.DialURL(a.url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.timeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.timeout)
+	if a.startTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// bindService authenticates as the search account, or anonymously when no
+// LDAP_BIND_DN is set.
+func (a *ldapAuthenticator) bindService(conn *ldap.Conn) error {
+	if a.bindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(a.bindDN, a.bindPassword)
+}
+
+func (a *ldapAuthenticator) Authenticate(username, password string) (UserCredentials, error) {
+	// An empty password would turn the bind into an unauthenticated bind,
+	// which most servers accept for any DN.
+	if username == "" || password == "" {
+		return UserCredentials{}, errInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return UserCredentials{}, err
+	}
+	defer conn.Close()
+
+	if err := a.bindService(conn); err != nil {
+		return UserCredentials{}, fmt.Errorf("service bind: %w", err)
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.timeout.Seconds()), false,
+		fmt.Sprintf(a.userFilter, ldap.EscapeFilter(username)),
+		[]string{"mail", "givenName", "sn"}, nil))
+	if err != nil {
+		return UserCredentials{}, fmt.Errorf("user search: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return UserCredentials{}, errInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return UserCredentials{}, errInvalidCredentials
+		}
+		return UserCredentials{}, fmt.Errorf("user bind: %w", err)
+	}
+
+	// Group membership is read with the service account again, since users
+	// may not be allowed to search the group tree.
+	if err := a.bindService(conn); err != nil {
+		return UserCredentials{}, fmt.Errorf("service bind: %w", err)
+	}
+	role, err := a.role(conn, entry.DN)
+	if err != nil {
+		return UserCredentials{}, err
+	}
+
+	return provisionDirectoryUser(directoryUser{
+		Username:  username,
+		Email:     entry.GetAttributeValue("mail"),
+		FirstName: entry.GetAttributeValue("givenName"),
+		LastName:  entry.GetAttributeValue("sn"),
+		Role:      role,
+	})
+}
+
+// role maps the user's groups to the highest-privileged gateway role, or
+// the default role if none of the groups is mapped.
+func (a *ldapAuthenticator) role(conn *ldap.Conn, userDN string) (string, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.groupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(a.timeout.Seconds()), false,
+		fmt.Sprintf(a.groupFilter, ldap.EscapeFilter(userDN)),
+		[]string{a.groupAttr}, nil))
+	if err != nil {
+		return "", fmt.Errorf("group search: %w", err)
+	}
+
+	groups := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.GetAttributeValue(a.groupAttr))
+	}
+	return a.mapRole(groups), nil
+}
+
+// mapRole picks the highest-privileged role any of the groups maps to.
+func (a *ldapAuthenticator) mapRole(groups []string) string {
+	role := a.defaultRole
+	for _, group := range groups {
+		mapped, ok := a.roleMap[strings.ToLower(group)]
+		if ok && rolePriority[mapped] > rolePriority[role] {
+			role = mapped
+		}
+	}
+	return role
+}
+
+type directoryUser struct {
+	Username  string
+	Email     string
+	FirstName string
+	LastName  string
+	Role      string
+}
+
+// provisionDirectoryUser creates the users and user_credentials rows of a
+// directory user on first login and refreshes their profile and role on
+// later ones. If a local account or a profile without credentials already
+// holds the username, it is left alone and the login is refused.
+func provisionDirectoryUser(u directoryUser) (UserCredentials, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return UserCredentials{}, err
+	}
+	defer tx.Rollback()
+
+	creds := UserCredentials{Username: u.Username, Role: u.Role}
+	var source, previousRole string
+	roleChanged := false
+	err = tx.QueryRow("SELECT user_id, auth_source, role FROM user_credentials WHERE username = $1 FOR UPDATE", u.Username).
+		Scan(&creds.UserID, &source, &previousRole)
+	switch {
+	case err == sql.ErrNoRows:
+		err = tx.QueryRow(`INSERT INTO users (username, email, first_name, last_name) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (username) DO NOTHING RETURNING id`, u.Username, u.Email, u.FirstName, u.LastName).Scan(&creds.UserID)
+		if err == sql.ErrNoRows {
+			log.Printf("Refusing directory login for %s: a user profile without credentials has the username", u.Username)
+			return UserCredentials{}, errInvalidCredentials
+		}
+		if err != nil {
+			return UserCredentials{}, err
+		}
+		// The directory manages the address, so it counts as verified.
+		_, err = tx.Exec(`INSERT INTO user_credentials (user_id, username, password_hash, role, auth_source, email_verified_at)
+			VALUES ($1, $2, '', $3, $4, NOW())`, creds.UserID, u.Username, u.Role, AuthSourceLDAP)
+		if err != nil {
+			return UserCredentials{}, err
+		}
+		log.Printf("Provisioned directory user %s (%d) as %s", u.Username, creds.UserID, u.Role)
+	case err != nil:
+		return UserCredentials{}, err
+	case source != AuthSourceLDAP:
+		log.Printf("Refusing directory login for %s: the username belongs to a %s account", u.Username, source)
+		return UserCredentials{}, errInvalidCredentials
+	default:
+		_, err = tx.Exec("UPDATE users SET email = $1, first_name = $2, last_name = $3 WHERE id = $4",
+			u.Email, u.FirstName, u.LastName, creds.UserID)
+		if err != nil {
+			return UserCredentials{}, err
+		}
+		if previousRole != u.Role {
+			_, err = tx.Exec("UPDATE user_credentials SET role = $1, updated_at = NOW() WHERE user_id = $2", u.Role, creds.UserID)
+			if err != nil {
+				return UserCredentials{}, err
+			}
+			log.Printf("Directory groups changed role of %s from %s to %s", u.Username, previousRole, u.Role)
+			roleChanged = true
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return UserCredentials{}, err
+	}
+	// Tokens carry the role, so existing ones would keep the old permissions.
+	if roleChanged {
+		if _, err := revocations.RevokeUser(creds.UserID, u.Username); err != nil {
+			return UserCredentials{}, err
+		}
+	}
+	return creds, nil
+}
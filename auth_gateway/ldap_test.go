@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+func TestLDAPMapRole(t *testing.T) {
+	a := &ldapAuthenticator{
+		defaultRole: RolePatron,
+		roleMap:     map[string]string{"library-staff": RoleLibrarian, "library-admins": RoleAdmin, "readers": RolePatron},
+	}
+	tests := []struct {
+		groups []string
+		want   string
+	}{
+		{nil, RolePatron},
+		{[]string{"unmapped"}, RolePatron},
+		{[]string{"readers"}, RolePatron},
+		{[]string{"Library-Staff"}, RoleLibrarian},
+		{[]string{"library-staff", "library-admins"}, RoleAdmin},
+		{[]string{"library-admins", "library-staff", "readers"}, RoleAdmin},
+	}
+	for _, tt := range tests {
+		if got := a.mapRole(tt.groups); got != tt.want {
+			t.Errorf("mapRole(%v) = %s, want %s", tt.groups, got, tt.want)
+		}
+	}
+
+	// A default role above a mapped one is not lowered by it.
+	a.defaultRole = RoleLibrarian
+	if got := a.mapRole([]string{"readers"}); got != RoleLibrarian {
+		t.Errorf("mapRole(readers) with default librarian = %s, want %s", got, RoleLibrarian)
+	}
+}
+
+func TestProvisionDirectoryUser(t *testing.T) {
+	user := directoryUser{Username: "jdoe", Email: "jdoe@example.com", FirstName: "John", LastName: "Doe", Role: RoleLibrarian}
+	credentials := func(source, role string) []driver.Value { return []driver.Value{int64(7), source, role} }
+
+	tests := []struct {
+		name        string
+		credentials []driver.Value // the user_credentials row holding the username
+		profile     []driver.Value // the users row the insert returns
+		wantErr     error
+		wantID      int64
+		created     bool
+		updated     bool
+		revoked     bool
+	}{
+		{"first login", nil, []driver.Value{int64(5)}, nil, 5, true, false, false},
+		{"profile without credentials", nil, nil, errInvalidCredentials, 0, false, false, false},
+		{"local account", credentials(AuthSourceLocal, RoleLibrarian), nil, errInvalidCredentials, 0, false, false, false},
+		{"same role", credentials(AuthSourceLDAP, RoleLibrarian), nil, nil, 7, false, true, false},
+		{"new role", credentials(AuthSourceLDAP, RolePatron), nil, nil, 7, false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupAuth(t)
+			fake := &fakeDB{rows: []fakeRow{
+				{"FROM user_credentials WHERE username", tt.credentials},
+				{"INSERT INTO users", tt.profile},
+			}}
+			openFakeDB(t, fake)
+			revocations = newRevocationStore(db)
+
+			creds, err := provisionDirectoryUser(user)
+			if err != tt.wantErr {
+				t.Fatalf("provisionDirectoryUser error = %v, want %v", err, tt.wantErr)
+			}
+			if creds.UserID != tt.wantID {
+				t.Errorf("user id = %d, want %d", creds.UserID, tt.wantID)
+			}
+			if created := fake.ran("INSERT INTO user_credentials"); created != tt.created {
+				t.Errorf("credentials created = %v, want %v", created, tt.created)
+			}
+			if updated := fake.ran("UPDATE users SET email"); updated != tt.updated {
+				t.Errorf("profile updated = %v, want %v", updated, tt.updated)
+			}
+			if changed := fake.ran("UPDATE user_credentials SET role"); changed != tt.revoked {
+				t.Errorf("role changed = %v, want %v", changed, tt.revoked)
+			}
+			if revoked := fake.ran("INSERT INTO user_token_revocations"); revoked != tt.revoked {
+				t.Errorf("tokens revoked = %v, want %v", revoked, tt.revoked)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Login failures are counted per subject, either "user:<username>" or
+// "ip:<address>". Once a subject reaches its threshold it is locked for
+// lockoutBase * 2^(previous lockouts), capped at lockoutMax. The count starts
+// over when the previous failure is older than failureWindow.
+var (
+	maxFailuresPerUser = 5
+	maxFailuresPerIP   = 20
+	failureWindow      = 15 * time.Minute
+	lockoutBase        = time.Minute
+	lockoutMax         = time.Hour
+	trustForwardedFor  = false
+)
+
+const (
+	EventLoginSuccess = "login_success"
+	EventLoginFailed  = "login_failed"
+	EventLoginLocked  = "login_locked"
+	EventLockout      = "lockout"
+	EventUnlock       = "unlock"
+)
+
+func loadLockoutConfig() {
+	maxFailuresPerUser = getEnvInt("LOGIN_MAX_FAILURES", maxFailuresPerUser)
+	maxFailuresPerIP = getEnvInt("LOGIN_MAX_FAILURES_PER_IP", maxFailuresPerIP)
+	failureWindow = getEnvDuration("LOGIN_FAILURE_WINDOW", failureWindow)
+	lockoutBase = getEnvDuration("LOCKOUT_BASE_DURATION", lockoutBase)
+	lockoutMax = getEnvDuration("LOCKOUT_MAX_DURATION", lockoutMax)
+	trustForwardedFor = getEnv("TRUST_FORWARDED_FOR", "false") == "true"
+}
+
+// clientIP returns the caller's address. X-Forwarded-For is only honoured when
+// the gateway runs behind a trusted proxy.
+func clientIP(r *http.Request) string {
+	if trustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func recordAuthEvent(username, ip, event string) {
+	_, err := db.Exec("INSERT INTO auth_events (username, client_ip, event) VALUES ($1, $2, $3)", username, ip, event)
+	if err != nil {
+		log.Printf("Failed to record auth event %s for %s: %v", event, username, err)
+	}
+}
+
+// checkLockout returns how long the username or client IP stays locked, or
+// zero if neither is.
+func checkLockout(username, ip string) (time.Duration, error) {
+	var lockedUntil sql.NullTime
+	err := db.QueryRow("SELECT MAX(locked_until) FROM login_failures WHERE subject IN ($1, $2) AND locked_until > NOW()",
+		"user:"+username, "ip:"+ip).Scan(&lockedUntil)
+	if err != nil || !lockedUntil.Valid {
+		return 0, err
+	}
+	return time.Until(lockedUntil.Time), nil
+}
+
+func recordLoginFailure(username, ip string) {
+	recordAuthEvent(username, ip, EventLoginFailed)
+	for subject, threshold := range map[string]int{"user:" + username: maxFailuresPerUser, "ip:" + ip: maxFailuresPerIP} {
+		if err := countFailure(subject, threshold); err != nil {
+			log.Printf("Failed to record login failure for %s: %v", subject, err)
+		}
+	}
+}
+
+func countFailure(subject string, threshold int) error {
+	var failed, lockouts int
+	err := db.QueryRow(`INSERT INTO login_failures (subject, failed_count, last_failed_at) VALUES ($1, 1, NOW())
+		ON CONFLICT (subject) DO UPDATE SET last_failed_at = NOW(),
+			failed_count = CASE WHEN login_failures.last_failed_at < NOW() - make_interval(secs => $2) THEN 1
+				ELSE login_failures.failed_count + 1 END
+		RETURNING failed_count, lockout_count`, subject, failureWindow.Seconds()).Scan(&failed, &lockouts)
+	if err != nil {
+		return err
+	}
+	if failed < threshold {
+		return nil
+	}
+
+	duration := time.Duration(float64(lockoutBase) * math.Pow(2, float64(lockouts)))
+	if duration <= 0 || duration > lockoutMax {
+		duration = lockoutMax
+	}
+	_, err = db.Exec(`UPDATE login_failures SET failed_count = 0, lockout_count = lockout_count + 1, locked_until = $2
+		WHERE subject = $1`, subject, time.Now().Add(duration))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Locked %s for %s after %d failed logins", subject, duration, failed)
+	if kind, value, _ := strings.Cut(subject, ":"); kind == "ip" {
+		recordAuthEvent("", value, EventLockout)
+	} else {
+		recordAuthEvent(value, "", EventLockout)
+	}
+	return nil
+}
+
+// recordLoginSuccess clears the username's failure counter and lockout
+// history. The IP counter is kept so a valid account cannot be used to reset
+// it between guesses at other accounts.
+func recordLoginSuccess(username, ip string) {
+	recordAuthEvent(username, ip, EventLoginSuccess)
+	resetLoginFailures(username)
+}
+
+func resetLoginFailures(username string) {
+	if _, err := db.Exec("DELETE FROM login_failures WHERE subject = $1", "user:"+username); err != nil {
+		log.Printf("Failed to reset login failures for %s: %v", username, err)
+	}
+}
+
+// confirmPassword runs check, which re-checks the password of a logged-in
+// caller, under the same lockout as /auth/login, so a stolen access token
+// cannot be used to guess the password. check returns errInvalidCredentials
+// for a wrong password. confirmPassword answers the request and returns
+// false unless the password was right.
+func confirmPassword(w http.ResponseWriter, r *http.Request, username string, check func() error) bool {
+	ip := clientIP(r)
+	remaining, err := checkLockout(username, ip)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if remaining > 0 {
+		recordAuthEvent(username, ip, EventLoginLocked)
+		sendLocked(w, remaining)
+		return false
+	}
+
+	err = check()
+	if err == errInvalidCredentials {
+		recordLoginFailure(username, ip)
+		sendUnauthorized(w, "Password is incorrect")
+		return false
+	}
+	if err != nil {
+		sendError(w, err.Error(), "Authentication backend error", http.StatusInternalServerError)
+		return false
+	}
+	resetLoginFailures(username)
+	return true
+}
+
+func sendLocked(w http.ResponseWriter, remaining time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error:   "Too many failed login attempts",
+		Message: fmt.Sprintf("Try again in %s", remaining.Round(time.Second)),
+	})
+}
+
+func handleListLockouts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT subject, lockout_count, locked_until FROM login_failures
+		WHERE locked_until > NOW() ORDER BY locked_until DESC`)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	lockouts := make([]LockoutResponse, 0)
+	for rows.Next() {
+		var l LockoutResponse
+		if err := rows.Scan(&l.Subject, &l.LockoutCount, &l.LockedUntil); err != nil {
+			sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+			return
+		}
+		lockouts = append(lockouts, l)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lockouts)
+}
+
+func handleUnlockAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	result, err := db.ExecContext(r.Context(), "DELETE FROM login_failures WHERE subject = $1", "user:"+username)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		sendError(w, "", "No lockout for this user", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Account %s unlocked by %s", username, requestClaims(r).Username)
+	recordAuthEvent(username, clientIP(r), EventUnlock)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConfirmPasswordUsesLockout(t *testing.T) {
+	tests := []struct {
+		name        string
+		lockedUntil driver.Value
+		checkErr    error
+		want        bool
+		wantStatus  int
+		failure     bool
+	}{
+		{"right password", nil, nil, true, http.StatusOK, false},
+		{"wrong password", nil, errInvalidCredentials, false, http.StatusUnauthorized, true},
+		{"locked out", time.Now().Add(time.Minute), nil, false, http.StatusTooManyRequests, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDB{rows: []fakeRow{
+				{"SELECT MAX(locked_until)", []driver.Value{tt.lockedUntil}},
+				{"INSERT INTO login_failures", []driver.Value{int64(1), int64(0)}},
+			}}
+			openFakeDB(t, fake)
+
+			checked := false
+			rec := httptest.NewRecorder()
+			got := confirmPassword(rec, httptest.NewRequest("POST", "/auth/password", nil), "bob", func() error {
+				checked = true
+				return tt.checkErr
+			})
+			if got != tt.want || rec.Code != tt.wantStatus {
+				t.Errorf("confirmPassword = %v with %d, want %v with %d", got, rec.Code, tt.want, tt.wantStatus)
+			}
+			if locked := tt.lockedUntil != nil; checked == locked {
+				t.Errorf("password checked = %v while locked = %v", checked, locked)
+			}
+			if failure := fake.ran("INSERT INTO login_failures"); failure != tt.failure {
+				t.Errorf("failure counted = %v, want %v", failure, tt.failure)
+			}
+		})
+	}
+}
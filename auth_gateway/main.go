@@ -1,16 +1,21 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -21,8 +26,13 @@ import (
 )
 
 var (
-	db        *sql.DB
-	jwtSecret = []byte("24abd7d0df965baabb514fc50c30f30a04e82ac50260700c35089ab593479015")
+	db              *sql.DB
+	signingKeys     *keyRing
+	notifier        Notifier
+	authenticator   Authenticator
+	revocations     *revocationStore
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
 )
 
 func main() {
@@ -32,15 +42,66 @@ func main() {
 	dbUser := getEnv("DB_USER", "postgres")
 	dbPass := getEnv("DB_PASSWORD", "postgres")
 	dbName := getEnv("DB_NAME", "library")
-	jwtSecretEnv := getEnv("JWT_SECRET", "")
-	if jwtSecretEnv != "" {
-		jwtSecret = []byte(jwtSecretEnv)
+	accessTokenTTL = getEnvDuration("ACCESS_TOKEN_TTL", accessTokenTTL)
+	refreshTokenTTL = getEnvDuration("REFRESH_TOKEN_TTL", refreshTokenTTL)
+	loadLockoutConfig()
+	loadMFAConfig()
+	loadOAuthConfig()
+	if err := loadEmailVerificationConfig(); err != nil {
+		log.Fatal("Failed to load email verification config:", err)
 	}
+	loadIdentityConfig()
+	if err := loadPasswordPolicy(); err != nil {
+		log.Fatal("Failed to load password policy:", err)
+	}
+	passwordResetTTL = getEnvDuration("PASSWORD_RESET_TTL", passwordResetTTL)
+	passwordResetURL = getEnv("PASSWORD_RESET_URL", passwordResetURL)
+
+	routesFile = getEnv("ROUTES_FILE", routesFile)
+	if err := loadRoutes(routesFile); err != nil {
+		log.Fatal("Failed to load routes:", err)
+	}
+	go watchRouteReloads(routesFile)
+
+	rateLimits, err = newRateLimitStore()
+	if err != nil {
+		log.Fatal("Failed to set up rate limit store:", err)
+	}
+
+	notifier, err = newNotifier()
+	if err != nil {
+		log.Fatal("Failed to set up notifier:", err)
+	}
+
+	authenticator, err = newAuthenticator()
+	if err != nil {
+		log.Fatal("Failed to set up authentication backends:", err)
+	}
+
+	keyRotation := getEnvDuration("JWT_KEY_ROTATION_INTERVAL", 24*time.Hour)
+	signingKeys, err = newKeyRing(
+		getEnv("JWT_KEY_DIR", "keys"),
+		getEnv("JWT_SIGNING_ALG", "RS256"),
+		keyRotation,
+		getEnvDuration("JWT_KEY_RETENTION", 2*keyRotation),
+	)
+	if err != nil {
+		log.Fatal("Failed to set up signing keys:", err)
+	}
+	if err := signingKeys.Load(); err != nil {
+		log.Fatal("Failed to load signing keys:", err)
+	}
+	go signingKeys.Schedule()
 
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		dbHost, dbPort, dbUser, dbPass, dbName)
 
-	db, err = sql.Open("postgres", connStr)
+	shutdownTracing, err := setupTracing()
+	if err != nil {
+		log.Fatal("Failed to set up tracing:", err)
+	}
+
+	db, err = openDB(connStr, dbName)
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
@@ -52,28 +113,102 @@ func main() {
 
 	log.Println("Auth Gateway connected to database")
 
+	err = bootstrapAdmin(getEnv("ADMIN_USERNAME", "admin"), getEnv("ADMIN_PASSWORD", ""), getEnv("ADMIN_EMAIL", "admin@example.com"))
+	if err != nil {
+		log.Fatal("Failed to create admin account:", err)
+	}
+	registerMetrics(dbName)
+
+	revocations = newRevocationStore(db)
+	if err := revocations.Load(); err != nil {
+		log.Fatal("Failed to load token revocations:", err)
+	}
+	go revocations.Sync(getEnvDuration("REVOCATION_SYNC_INTERVAL", 30*time.Second))
+
 	router := mux.NewRouter()
+	router.HandleFunc("/.well-known/jwks.json", handleJWKS)
+	router.HandleFunc("/.well-known/openid-configuration", handleOpenIDConfiguration)
+	router.HandleFunc("/oauth/authorize", handleOAuthAuthorize)
+	router.HandleFunc("/oauth/token", handleOAuthToken)
+	router.HandleFunc(oauthUserInfoPath, jwtMiddleware(handleUserInfo))
 	router.HandleFunc("/auth/login", handleLogin)
 	router.HandleFunc("/auth/register", handleRegister)
 	router.HandleFunc("/auth/validate", handleValidate)
-	router.HandleFunc("/api/books", jwtMiddleware(proxyBooks))
-	router.PathPrefix("/api/books/").HandlerFunc(jwtMiddleware(proxyBooks))
-	router.HandleFunc("/api/users", jwtMiddleware(proxyUsers))
-	router.PathPrefix("/api/users/").HandlerFunc(jwtMiddleware(proxyUsers))
-	router.HandleFunc("/api/loans", jwtMiddleware(proxyLoans))
-	router.PathPrefix("/api/loans/").HandlerFunc(jwtMiddleware(proxyLoans))
+	router.HandleFunc("/auth/me", jwtMiddleware(handleMe))
+	router.HandleFunc("/auth/refresh", handleRefresh)
+	router.HandleFunc("/auth/logout", handleLogout)
+	router.HandleFunc("/auth/verify", handleVerifyEmail)
+	router.HandleFunc("/auth/verify/resend", handleResendVerification)
+	router.HandleFunc("/auth/password", jwtMiddleware(handleChangePassword))
+	router.HandleFunc("/auth/password/forgot", handleForgotPassword)
+	router.HandleFunc("/auth/password/reset", handleResetPassword)
+	router.HandleFunc("/auth/login/mfa", handleLoginMFA)
+	router.HandleFunc("/auth/mfa/enroll", jwtMiddleware(handleMFAEnroll))
+	router.HandleFunc("/auth/mfa/confirm", jwtMiddleware(handleMFAConfirm))
+	router.HandleFunc("/auth/mfa/disable", jwtMiddleware(handleMFADisable))
+	router.HandleFunc("/auth/revoke", jwtMiddleware(handleRevokeSelf))
+	router.HandleFunc("/auth/sessions", jwtMiddleware(handleSessions))
+	router.HandleFunc("/auth/sessions/{id}", jwtMiddleware(handleRevokeSession))
+	router.HandleFunc("/auth/oauth/consents", jwtMiddleware(handleListConsents))
+	router.HandleFunc("/auth/oauth/consents/{clientId}", jwtMiddleware(handleRevokeConsent))
+	router.HandleFunc("/admin/tokens/revoke", jwtMiddleware(authorize(handleRevokeToken)))
+	router.HandleFunc("/admin/users/{id}/revoke-tokens", jwtMiddleware(authorize(handleRevokeUserTokens)))
+	router.HandleFunc("/admin/lockouts", jwtMiddleware(authorize(handleListLockouts)))
+	router.HandleFunc("/admin/lockouts/{username}", jwtMiddleware(authorize(handleUnlockAccount)))
+	router.HandleFunc("/admin/api-keys", jwtMiddleware(authorize(handleAPIKeys)))
+	router.HandleFunc("/admin/api-keys/{id}", jwtMiddleware(authorize(handleRevokeAPIKey)))
+	router.HandleFunc("/admin/users/{id}/role", jwtMiddleware(authorize(handleSetUserRole)))
+	router.HandleFunc("/admin/oauth/clients", jwtMiddleware(authorize(handleOAuthClients)))
+	router.HandleFunc("/admin/oauth/clients/{id}", jwtMiddleware(authorize(handleDeleteOAuthClient)))
+	router.HandleFunc("/admin/breakers", jwtMiddleware(authorize(handleListBreakers)))
+	router.HandleFunc("/healthz", handleHealthz)
+	router.HandleFunc("/readyz", handleReadyz)
+	router.HandleFunc("/status", jwtMiddleware(authorize(handleStatus)))
+	// Everything else is served from the route file.
+	router.NotFoundHandler = http.HandlerFunc(serveRoute)
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-API-Key", HeaderRequestID},
+		ExposedHeaders:   []string{HeaderRequestID},
 		AllowCredentials: true,
 	})
 
-	handler := c.Handler(router)
+	handler := tracingMiddleware(router, metricsMiddleware(router, requestIDMiddleware(c.Handler(router))))
+
+	go serveMetrics(getEnv("METRICS_ADDR", ":9091"))
 
 	log.Println("Auth Gateway starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	serve(&http.Server{Addr: ":8080", Handler: handler}, shutdownTracing)
+}
+
+// shutdownTimeout stays under the 10 seconds docker stop waits before it
+// kills the process.
+const shutdownTimeout = 8 * time.Second
+
+// serve runs server until SIGINT or SIGTERM, then lets the requests in
+// flight finish and flushes the spans not yet exported.
+func serve(server *http.Server, shutdownTracing func(context.Context) error) {
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal("Failed to serve:", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Failed to finish open requests:", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Println("Failed to flush traces:", err)
+	}
 }
 
 func getEnv(key, defaultValue string) string {
@@ -83,6 +218,32 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer for %s (%q), using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration for %s (%q), using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
 func handleLogin(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
@@ -95,39 +256,95 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var userID int64
-	var passwordHash string
-	err := db.QueryRow("SELECT user_id, password_hash FROM user_credentials WHERE username = $1", req.Username).Scan(&userID, &passwordHash)
-	if err == sql.ErrNoRows {
+	ip := clientIP(r)
+	remaining, err := checkLockout(req.Username, ip)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if remaining > 0 {
+		recordAuthEvent(req.Username, ip, EventLoginLocked)
+		sendLocked(w, remaining)
+		return
+	}
+
+	creds, err := authenticator.Authenticate(req.Username, req.Password)
+	if err == errInvalidCredentials {
+		recordLoginFailure(req.Username, ip)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid username or password"})
 		return
 	}
 	if err != nil {
-		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		sendError(w, err.Error(), "Authentication backend error", http.StatusInternalServerError)
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)); err != nil {
+	if !requireVerifiedEmail(w, creds.UserID, EmailVerificationLogin) {
+		return
+	}
+
+	mfaEnabled, err := hasMFAEnabled(creds.UserID)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if mfaEnabled {
+		challenge, err := generateMFAChallenge(creds)
+		if err != nil {
+			sendError(w, err.Error(), "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid username or password"})
+		json.NewEncoder(w).Encode(MFAChallengeResponse{
+			MFARequired: true,
+			MFAToken:    challenge,
+			ExpiresIn:   int(mfaChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	recordLoginSuccess(req.Username, ip)
+	completeLogin(w, r, loginGrant{UserCredentials: creds})
+}
+
+// completeLogin starts a new session and refresh token family and writes the
+// token pair.
+func completeLogin(w http.ResponseWriter, r *http.Request, grant loginGrant) {
+	familyID, err := newTokenFamilyID()
+	if err != nil {
+		sendError(w, err.Error(), "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	grant.FamilyID = familyID
+	grant.SessionID = familyID
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := createSession(tx, grant.SessionID, grant.UserID, r); err != nil {
+		sendError(w, err.Error(), "Failed to create session", http.StatusInternalServerError)
 		return
 	}
 
-	token, err := generateJWT(req.Username)
+	resp, err := issueTokens(tx, grant)
 	if err != nil {
 		sendError(w, err.Error(), "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		sendError(w, err.Error(), "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(LoginResponse{
-		Token:     token,
-		Username:  req.Username,
-		ExpiresIn: 36000,
-	})
+	json.NewEncoder(w).Encode(resp)
 }
 
 func handleRegister(w http.ResponseWriter, r *http.Request) {
@@ -141,9 +358,13 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		sendError(w, err.Error(), "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if fields := validateRegistration(req); len(fields) > 0 {
+		sendValidationError(w, fields)
+		return
+	}
 
 	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", req.Username).Scan(&exists)
+	err := db.QueryRowContext(r.Context(), "SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)", req.Username).Scan(&exists)
 	if err != nil {
 		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
 		return
@@ -155,7 +376,7 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(r.Context(), nil)
 	if err != nil {
 		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
 		return
@@ -163,7 +384,7 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	var userID int64
-	err = tx.QueryRow("INSERT INTO users (username, email, first_name, last_name) VALUES ($1, $2, $3, $4) RETURNING id",
+	err = tx.QueryRowContext(r.Context(), "INSERT INTO users (username, email, first_name, last_name) VALUES ($1, $2, $3, $4) RETURNING id",
 		req.Username, req.Email, req.FirstName, req.LastName).Scan(&userID)
 	if err != nil {
 		sendError(w, err.Error(), "Failed to create user", http.StatusInternalServerError)
@@ -176,7 +397,7 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = tx.Exec("INSERT INTO user_credentials (user_id, username, password_hash) VALUES ($1, $2, $3)",
+	_, err = tx.ExecContext(r.Context(), "INSERT INTO user_credentials (user_id, username, password_hash) VALUES ($1, $2, $3)",
 		userID, req.Username, string(hashedPassword))
 	if err != nil {
 		sendError(w, err.Error(), "Failed to create credentials", http.StatusInternalServerError)
@@ -188,6 +409,10 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The account exists either way; a lost message can be sent again
+	// through /auth/verify/resend.
+	sendVerificationEmail(userID, req.Username, req.Email)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(UserResponse{
@@ -211,7 +436,7 @@ func handleValidate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username, err := validateJWT(req.Token)
+	claims, err := authenticateToken(req.Token)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
@@ -225,103 +450,175 @@ func handleValidate(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(ValidateResponse{
 		Valid:    true,
-		Username: username,
+		Username: claims.Username,
+		Role:     claims.Role,
 	})
 }
 
-func generateJWT(username string) (string, error) {
+// microsecondDate writes t as a JWT NumericDate with microsecond precision.
+// Access tokens carry their iat this way so a user revocation can tell apart
+// tokens issued within the same second.
+func microsecondDate(t time.Time) json.Number {
+	return json.Number(fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000))
+}
+
+func generateJWT(grant loginGrant) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
 	now := time.Now()
 	claims := jwt.MapClaims{
-		"sub": username,
-		"iat": now.Unix(),
-		"exp": now.Add(10 * time.Hour).Unix(),
+		"typ":  TokenTypeAccess,
+		"sub":  grant.Username,
+		"uid":  grant.UserID,
+		"role": grant.Role,
+		"mfa":  grant.MFA,
+		"jti":  jti,
+		"iat":  microsecondDate(now),
+		"exp":  now.Add(accessTokenTTL).Unix(),
+		"iss":  oidcIssuer,
+	}
+	if grant.SessionID != "" {
+		claims["sid"] = grant.SessionID
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	if grant.ClientID != "" {
+		claims["client_id"] = grant.ClientID
+		claims["scope"] = grant.Scope
+	}
+	return signJWT(claims)
 }
 
-func validateJWT(tokenString string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method")
-		}
-		return jwtSecret, nil
-	})
+func validateJWT(tokenString string) (*TokenClaims, error) {
+	return validateTokenOfType(tokenString, TokenTypeAccess)
+}
+
+// validateTokenOfType checks the signature, expiry and typ claim, so that
+// e.g. an MFA challenge token can never be used as an access token.
+func validateTokenOfType(tokenString, typ string) (*TokenClaims, error) {
+	token, err := parseJWT(tokenString)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		username, ok := claims["sub"].(string)
-		if !ok {
-			return "", fmt.Errorf("invalid token claims")
-		}
-		return username, nil
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if claims["typ"] != typ {
+		return nil, fmt.Errorf("unexpected token type")
+	}
+
+	username, ok := claims["sub"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid token claims")
+	}
+
+	result := &TokenClaims{Username: username}
+	if uid, ok := claims["uid"].(float64); ok {
+		result.UserID = int64(uid)
+	}
+	result.Role, _ = claims["role"].(string)
+	result.MFA, _ = claims["mfa"].(bool)
+	result.ID, _ = claims["jti"].(string)
+	result.SessionID, _ = claims["sid"].(string)
+	result.ClientID, _ = claims["client_id"].(string)
+	result.Email, _ = claims["email"].(string)
+	if scope, ok := claims["scope"].(string); ok {
+		result.Scopes = strings.Fields(scope)
+	}
+	if iat, ok := claims["iat"].(float64); ok {
+		result.IssuedAt = time.UnixMicro(int64(math.Round(iat * 1e6)))
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		result.ExpiresAt = exp.Time
+	}
+	return result, nil
+}
+
+// authenticateToken validates the token signature and expiry and then checks
+// it against the revocation store.
+func authenticateToken(tokenString string) (*TokenClaims, error) {
+	claims, err := validateJWT(tokenString)
+	if err != nil {
+		return nil, err
 	}
-	return "", fmt.Errorf("invalid token")
+	if revocations.IsRevoked(claims) {
+		return nil, fmt.Errorf("token has been revoked")
+	}
+	return claims, nil
+}
+
+func bearerToken(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return ""
+	}
+	return parts[1]
 }
 
+func isAPIPath(path string) bool {
+	return strings.HasPrefix(path, "/api/") || path == "/api"
+}
+
+// jwtMiddleware authenticates the caller with a bearer JWT or, on /api
+// routes, with an X-API-Key header.
 func jwtMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(ErrorResponse{
-				Error:   "Unauthorized",
-				Message: "Valid JWT token required",
-			})
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			if !isAPIPath(r.URL.Path) {
+				sendForbidden(w, "API keys can only be used on /api routes")
+				return
+			}
+			claims, err := authenticateAPIKey(r.Context(), key)
+			if err != nil {
+				sendUnauthorized(w, "Valid API key required")
+				return
+			}
+			ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+			next(w, r.WithContext(ctx))
 			return
 		}
 
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(ErrorResponse{
-				Error:   "Unauthorized",
-				Message: "Valid JWT token required",
-			})
+		tokenString := bearerToken(r)
+		if tokenString == "" {
+			sendUnauthorized(w, "Valid JWT token required")
 			return
 		}
 
-		_, err := validateJWT(parts[1])
+		claims, err := authenticateToken(tokenString)
 		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(ErrorResponse{
-				Error:   "Unauthorized",
-				Message: "Valid JWT token required",
-			})
+			sendUnauthorized(w, "Valid JWT token required")
 			return
 		}
+		// Tokens issued to an OAuth client are limited to their scopes on the
+		// /api routes, like API keys; the gateway's own /auth and /admin
+		// endpoints are for the user's first-party sessions. Tokens issued
+		// for a user may also read /oauth/userinfo.
+		if (claims.ClientID != "" || claims.UserID == 0) && !isAPIPath(r.URL.Path) &&
+			(claims.UserID == 0 || r.URL.Path != oauthUserInfoPath) {
+			sendForbidden(w, "Client tokens can only be used on /api routes")
+			return
+		}
+		activity.Touch(claims.SessionID)
 
-		next(w, r)
-	}
-}
-
-func proxyBooks(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/api/books")
-	targetURL := "http://book_service:8081/api/books" + path
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next(w, r.WithContext(ctx))
 	}
-
-	proxyRequest(w, r, targetURL)
 }
 
-func proxyUsers(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/api/users")
-	targetURL := "http://user_service:8082/api/users" + path
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
-	}
-
-	proxyRequest(w, r, targetURL)
+// requestClaims returns the claims stored by jwtMiddleware, or nil on
+// unauthenticated routes.
+func requestClaims(r *http.Request) *TokenClaims {
+	claims, _ := r.Context().Value(claimsContextKey).(*TokenClaims)
+	return claims
 }
 
+// proxyLoans maps the REST loan API onto the loan service's SOAP operations.
+// It serves routes with handler: loans, whatever their prefix.
 func proxyLoans(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/api/loans")
+	path := strings.TrimPrefix(r.URL.Path, requestRoute(r).Prefix)
 
 	if r.Method == http.MethodPost && path == "" {
 		handleCreateLoan(w, r)
@@ -343,7 +640,7 @@ func proxyLoans(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Method == http.MethodGet && (path == "" || path == "/") {
+	if r.Method == http.MethodGet && path == "" {
 		handleGetAllLoans(w, r)
 		return
 	}
@@ -358,6 +655,19 @@ func handleCreateLoan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Patrons may omit userId and always borrow in their own name.
+	claims := requestClaims(r)
+	if req.UserID == 0 && claims != nil {
+		req.UserID = claims.UserID
+	}
+	if !canAccessUser(claims, req.UserID) {
+		sendForbidden(w, "You can only borrow books in your own name")
+		return
+	}
+	if !isStaff(claims.Role) && !requireVerifiedEmail(w, claims.UserID, EmailVerificationBorrow) {
+		return
+	}
+
 	soapBody := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
 <soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:loan="http://example.com/loan">
    <soapenv:Header/>
@@ -369,9 +679,9 @@ func handleCreateLoan(w http.ResponseWriter, r *http.Request) {
    </soapenv:Body>
 </soapenv:Envelope>`, req.UserID, req.BookID)
 
-	resp, err := http.Post("http://loan_service:8083/ws", "text/xml", bytes.NewBufferString(soapBody))
+	resp, err := postSOAP(r, soapBody, false)
 	if err != nil {
-		sendError(w, err.Error(), "Failed to contact loan service", http.StatusInternalServerError)
+		sendUpstreamError(w, err, "Failed to contact loan service")
 		return
 	}
 	defer resp.Body.Close()
@@ -431,6 +741,25 @@ func handleCreateLoan(w http.ResponseWriter, r *http.Request) {
 func handleReturnLoan(w http.ResponseWriter, r *http.Request, path string) {
 	loanID := strings.TrimSuffix(strings.TrimPrefix(path, "/"), "/return")
 
+	claims := requestClaims(r)
+	if claims == nil || !isStaff(claims.Role) {
+		loan, soapErr, err := fetchLoan(r, loanID)
+		if err != nil {
+			sendUpstreamError(w, err, "Failed to contact loan service")
+			return
+		}
+		if soapErr != "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: soapErr})
+			return
+		}
+		if !canAccessUser(claims, loan.UserID) {
+			sendForbidden(w, "You can only return your own loans")
+			return
+		}
+	}
+
 	soapBody := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
 <soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:loan="http://example.com/loan">
    <soapenv:Header/>
@@ -441,9 +770,9 @@ func handleReturnLoan(w http.ResponseWriter, r *http.Request, path string) {
    </soapenv:Body>
 </soapenv:Envelope>`, loanID)
 
-	resp, err := http.Post("http://loan_service:8083/ws", "text/xml", bytes.NewBufferString(soapBody))
+	resp, err := postSOAP(r, soapBody, false)
 	if err != nil {
-		sendError(w, err.Error(), "Failed to contact loan service", http.StatusInternalServerError)
+		sendUpstreamError(w, err, "Failed to contact loan service")
 		return
 	}
 	defer resp.Body.Close()
@@ -502,6 +831,16 @@ func handleReturnLoan(w http.ResponseWriter, r *http.Request, path string) {
 func handleGetLoansByUser(w http.ResponseWriter, r *http.Request, path string) {
 	userID := strings.TrimPrefix(path, "/user/")
 
+	ownerID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		sendError(w, err.Error(), "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if !canAccessUser(requestClaims(r), ownerID) {
+		sendForbidden(w, "You can only view your own loans")
+		return
+	}
+
 	soapBody := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
 <soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:loan="http://example.com/loan">
    <soapenv:Header/>
@@ -512,9 +851,9 @@ func handleGetLoansByUser(w http.ResponseWriter, r *http.Request, path string) {
    </soapenv:Body>
 </soapenv:Envelope>`, userID)
 
-	resp, err := http.Post("http://loan_service:8083/ws", "text/xml", bytes.NewBufferString(soapBody))
+	resp, err := postSOAP(r, soapBody, true)
 	if err != nil {
-		sendError(w, err.Error(), "Failed to contact loan service", http.StatusInternalServerError)
+		sendUpstreamError(w, err, "Failed to contact loan service")
 		return
 	}
 	defer resp.Body.Close()
@@ -568,6 +907,31 @@ func handleGetLoansByUser(w http.ResponseWriter, r *http.Request, path string) {
 func handleGetLoanById(w http.ResponseWriter, r *http.Request, path string) {
 	loanID := strings.TrimPrefix(path, "/")
 
+	loan, soapErr, err := fetchLoan(r, loanID)
+	if err != nil {
+		sendUpstreamError(w, err, "Failed to contact loan service")
+		return
+	}
+
+	if soapErr != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: soapErr})
+		return
+	}
+
+	if !canAccessUser(requestClaims(r), loan.UserID) {
+		sendForbidden(w, "You can only view your own loans")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(loan)
+}
+
+// fetchLoan calls the getLoanById SOAP operation. A non-empty second return
+// value is the error reported by the loan service itself.
+func fetchLoan(r *http.Request, loanID string) (LoanResponse, string, error) {
 	soapBody := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
 <soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:loan="http://example.com/loan">
    <soapenv:Header/>
@@ -578,10 +942,9 @@ func handleGetLoanById(w http.ResponseWriter, r *http.Request, path string) {
    </soapenv:Body>
 </soapenv:Envelope>`, loanID)
 
-	resp, err := http.Post("http://loan_service:8083/ws", "text/xml", bytes.NewBufferString(soapBody))
+	resp, err := postSOAP(r, soapBody, true)
 	if err != nil {
-		sendError(w, err.Error(), "Failed to contact loan service", http.StatusInternalServerError)
-		return
+		return LoanResponse{}, "", err
 	}
 	defer resp.Body.Close()
 
@@ -607,15 +970,11 @@ func handleGetLoanById(w http.ResponseWriter, r *http.Request, path string) {
 
 	var soapResp GetLoanByIdResponse
 	if err := xml.Unmarshal(body, &soapResp); err != nil {
-		sendError(w, err.Error(), "Failed to parse response", http.StatusInternalServerError)
-		return
+		return LoanResponse{}, "", fmt.Errorf("failed to parse response: %v", err)
 	}
 
 	if soapResp.Body.GetLoanByIdResponse.Error != "" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: soapResp.Body.GetLoanByIdResponse.Error})
-		return
+		return LoanResponse{}, soapResp.Body.GetLoanByIdResponse.Error, nil
 	}
 
 	loan := soapResp.Body.GetLoanByIdResponse.Loan
@@ -624,8 +983,7 @@ func handleGetLoanById(w http.ResponseWriter, r *http.Request, path string) {
 		returnDate = &loan.ReturnDate
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(LoanResponse{
+	return LoanResponse{
 		ID:         loan.ID,
 		UserID:     loan.UserID,
 		BookID:     loan.BookID,
@@ -633,10 +991,17 @@ func handleGetLoanById(w http.ResponseWriter, r *http.Request, path string) {
 		DueDate:    loan.DueDate,
 		ReturnDate: returnDate,
 		Status:     loan.Status,
-	})
+	}, "", nil
 }
 
 func handleGetAllLoans(w http.ResponseWriter, r *http.Request) {
+	// The route policy already limits this to staff; checked again because
+	// a policy mistake would expose every patron's loans.
+	if claims := requestClaims(r); claims == nil || !isStaff(claims.Role) {
+		sendForbidden(w, "Only staff can list all loans")
+		return
+	}
+
 	soapBody := `<?xml version="1.0" encoding="UTF-8"?>
 <soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:loan="http://example.com/loan">
    <soapenv:Header/>
@@ -645,9 +1010,9 @@ func handleGetAllLoans(w http.ResponseWriter, r *http.Request) {
    </soapenv:Body>
 </soapenv:Envelope>`
 
-	resp, err := http.Post("http://loan_service:8083/ws", "text/xml", bytes.NewBufferString(soapBody))
+	resp, err := postSOAP(r, soapBody, true)
 	if err != nil {
-		sendError(w, err.Error(), "Failed to contact loan service", http.StatusInternalServerError)
+		sendUpstreamError(w, err, "Failed to contact loan service")
 		return
 	}
 	defer resp.Body.Close()
@@ -698,33 +1063,24 @@ func handleGetAllLoans(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(loans)
 }
 
-func proxyRequest(w http.ResponseWriter, r *http.Request, targetURL string) {
-	client := &http.Client{Timeout: 10 * time.Second}
-
-	var body io.Reader
-	if r.Body != nil {
-		bodyBytes, _ := io.ReadAll(r.Body)
-		body = bytes.NewReader(bodyBytes)
-	}
-
-	req, err := http.NewRequest(r.Method, targetURL, body)
-	if err != nil {
-		sendError(w, err.Error(), "Failed to create request", http.StatusInternalServerError)
-		return
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		sendError(w, err.Error(), "Failed to contact service", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+// loanServiceSOAPPath is where the loan service accepts SOAP requests,
+// relative to the upstream URL of the loans route.
+const loanServiceSOAPPath = "/ws"
+
+// postSOAP sends a SOAP envelope to an upstream of the request's route.
+// Errors reported inside the envelope come back with status 200, so only
+// transport errors and 5xx answers count as failures. Only read-only
+// operations are idempotent and may be retried.
+func postSOAP(r *http.Request, envelope string, idempotent bool) (*http.Response, error) {
+	return requestRoute(r).do(r.Context(), idempotent, func(target *url.URL) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, target.String()+loanServiceSOAPPath, strings.NewReader(soapTraceHeader(r.Context(), envelope)))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/xml")
+		forwardHeaders(req, r)
+		return req, nil
+	})
 }
 
 func sendError(w http.ResponseWriter, err, message string, status int) {
@@ -733,3 +1089,21 @@ func sendError(w http.ResponseWriter, err, message string, status int) {
 	customError := fmt.Sprintf("%s: %v", message, err)
 	json.NewEncoder(w).Encode(ErrorResponse{Error: customError})
 }
+
+func sendUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error:   "Unauthorized",
+		Message: message,
+	})
+}
+
+func sendForbidden(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error:   "Forbidden",
+		Message: message,
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+// handleMe describes the caller in one round trip: who they are, how they
+// are signed in and what the gateway will let them do.
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := requestClaims(r)
+	var me MeResponse
+	var firstName, lastName sql.NullString
+	var verifiedAt sql.NullTime
+	var mfaEnabled sql.NullBool
+	err := db.QueryRowContext(r.Context(), `SELECT uc.user_id, uc.username, u.email, u.first_name, u.last_name, uc.role, uc.auth_source,
+			uc.email_verified_at, m.enabled
+		FROM user_credentials uc
+		JOIN users u ON u.id = uc.user_id
+		LEFT JOIN user_mfa m ON m.user_id = uc.user_id
+		WHERE uc.user_id = $1`, claims.UserID).
+		Scan(&me.UserID, &me.Username, &me.Email, &firstName, &lastName, &me.Role, &me.AuthSource,
+			&verifiedAt, &mfaEnabled)
+	if err == sql.ErrNoRows {
+		sendError(w, "", "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	me.FirstName = firstName.String
+	me.LastName = lastName.String
+	me.EmailVerified = verifiedAt.Valid
+	me.MFAEnabled = mfaEnabled.Bool
+	me.MFAAuthenticated = claims.MFA
+
+	if claims.SessionID != "" {
+		var s SessionResponse
+		err := db.QueryRowContext(r.Context(), `SELECT id, user_agent, client_ip, created_at, last_seen_at
+			FROM sessions WHERE id = $1 AND user_id = $2`, claims.SessionID, claims.UserID).
+			Scan(&s.ID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt)
+		if err != nil && err != sql.ErrNoRows {
+			sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			s.Current = true
+			me.Session = &s
+		}
+	}
+
+	// Permissions follow the role in the token, which is what authorize
+	// checks; a role change revokes older tokens anyway.
+	me.Permissions = effectivePermissions(claims.Role, claims.MFA)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(me)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEffectivePermissions(t *testing.T) {
+	setupAuth(t)
+	mfaRequiredRoles = map[string]bool{RoleAdmin: true}
+	t.Cleanup(func() { mfaRequiredRoles = map[string]bool{} })
+
+	all := routeMethods
+	tests := []struct {
+		role string
+		mfa  bool
+		want []Permission
+	}{
+		{RolePatron, false, []Permission{
+			{"/api/books", []string{"GET"}},
+			{"/api/books/*", []string{"GET"}},
+			{"/api/loans", []string{"POST"}},
+			{"/api/loans/*", []string{"GET", "POST", "PUT"}},
+		}},
+		{RoleLibrarian, false, []Permission{
+			{"/api/books", []string{"GET", "POST", "PUT", "DELETE"}},
+			{"/api/books/*", []string{"GET", "POST", "PUT", "DELETE"}},
+			{"/api/users", all},
+			{"/api/users/*", all},
+			{"/api/loans", []string{"GET", "POST"}},
+			{"/api/loans/*", []string{"GET", "POST", "PUT"}},
+			{"/status", []string{"GET"}},
+			{"/admin/lockouts", all},
+			{"/admin/lockouts/*", all},
+		}},
+		// Without the second factor the admin role grants nothing.
+		{RoleAdmin, false, []Permission{}},
+	}
+	for _, tt := range tests {
+		if got := effectivePermissions(tt.role, tt.mfa); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("effectivePermissions(%s, %v) =\n%v\nwant\n%v", tt.role, tt.mfa, got, tt.want)
+		}
+	}
+
+	admin := effectivePermissions(RoleAdmin, true)
+	if last := admin[len(admin)-1]; last.Path != "/admin/*" || !reflect.DeepEqual(last.Methods, all) {
+		t.Errorf("admin with MFA: last permission %v, want /admin/* with every method", last)
+	}
+}
+
+func TestHandleMe(t *testing.T) {
+	setupAuth(t)
+	verifiedAt := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	openFakeDB(t, &fakeDB{rows: []fakeRow{
+		{"FROM user_credentials uc", []driver.Value{int64(2), "bob", "bob@example.com", "Bob", nil, RolePatron, AuthSourceLocal, verifiedAt, nil}},
+	}})
+
+	claims := &TokenClaims{UserID: 2, Username: "bob", Role: RolePatron}
+	req := httptest.NewRequest(http.MethodGet, "/auth/me", nil)
+	rec := httptest.NewRecorder()
+	handleMe(rec, req.WithContext(context.WithValue(req.Context(), claimsContextKey, claims)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /auth/me = %d: %s", rec.Code, rec.Body)
+	}
+
+	var me MeResponse
+	if err := json.NewDecoder(rec.Body).Decode(&me); err != nil {
+		t.Fatal(err)
+	}
+	want := MeResponse{
+		UserID:        2,
+		Username:      "bob",
+		Email:         "bob@example.com",
+		FirstName:     "Bob",
+		EmailVerified: true,
+		Role:          RolePatron,
+		AuthSource:    AuthSourceLocal,
+		Permissions:   effectivePermissions(RolePatron, false),
+	}
+	if !reflect.DeepEqual(me, want) {
+		t.Errorf("GET /auth/me =\n%+v\nwant\n%+v", me, want)
+	}
+}
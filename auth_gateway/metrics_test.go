@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetricsMiddlewareLabels(t *testing.T) {
+	routes.Store(&routeTable{routes: []*route{{Name: "books", Prefix: "/api/books"}}})
+	t.Cleanup(func() { routes.Store(nil) })
+
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/users/{id}/role", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/books") {
+			// An informational answer first; the final status counts.
+			w.WriteHeader(http.StatusEarlyHints)
+			w.Write([]byte("[]"))
+			return
+		}
+		http.NotFound(w, r)
+	})
+	handler := metricsMiddleware(router, router)
+
+	for _, req := range []struct{ method, path string }{
+		{"PUT", "/admin/users/7/role"},
+		{"PUT", "/admin/users/8/role"},
+		{"GET", "/api/books/1"},
+		{"GET", "/no/such/page"},
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	exposition := rec.Body.String()
+	for _, want := range []string{
+		`http_requests_total{method="PUT",route="/admin/users/{id}/role",status="204"} 2`,
+		`http_requests_total{method="GET",route="books",status="200"} 1`,
+		`http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`http_request_duration_seconds_count{method="PUT",route="/admin/users/{id}/role"} 2`,
+	} {
+		if !strings.Contains(exposition, want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
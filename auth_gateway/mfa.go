@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TOTP parameters from RFC 6238 as understood by common authenticator apps.
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+const (
+	EventMFAEnabled      = "mfa_enabled"
+	EventMFADisabled     = "mfa_disabled"
+	EventMFAFailed       = "mfa_failed"
+	EventRecoveryCodeUse = "mfa_recovery_code_used"
+)
+
+var (
+	mfaIssuer        = "Library"
+	mfaChallengeTTL  = 5 * time.Minute
+	mfaRequiredRoles = map[string]bool{}
+)
+
+func loadMFAConfig() {
+	mfaIssuer = getEnv("MFA_ISSUER", mfaIssuer)
+	mfaChallengeTTL = getEnvDuration("MFA_CHALLENGE_TTL", mfaChallengeTTL)
+	for _, role := range strings.Split(getEnv("MFA_REQUIRED_ROLES", ""), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			mfaRequiredRoles[role] = true
+		}
+	}
+}
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP checks code against the steps around now and returns the
+// matching time step. Steps at or before lastStep are refused so a code
+// cannot be replayed.
+func verifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func provisioningURI(username, secret string) string {
+	label := url.PathEscape(mfaIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", mfaIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func hasMFAEnabled(userID int64) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT enabled FROM user_mfa WHERE user_id = $1", userID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// checkTOTP verifies a code for the user and records the step it used.
+func checkTOTP(userID int64, code string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var lastStep int64
+	err = tx.QueryRow("SELECT secret, last_used_step FROM user_mfa WHERE user_id = $1 FOR UPDATE", userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := verifyTOTP(secret, code, time.Now(), lastStep)
+	if !ok {
+		return false, nil
+	}
+	if _, err := tx.Exec("UPDATE user_mfa SET last_used_step = $1 WHERE user_id = $2", step, userID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// useRecoveryCode consumes one unused recovery code of the user.
+func useRecoveryCode(userID int64, code string) (bool, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	result, err := db.Exec("UPDATE mfa_recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+		userID, hashToken(code))
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n == 1, nil
+}
+
+// generateMFAChallenge issues the short-lived token returned by the first
+// login step. It only proves the password was right and is accepted solely
+// by /auth/login/mfa.
+func generateMFAChallenge(creds UserCredentials) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return signJWT(jwt.MapClaims{
+		"typ":  TokenTypeMFA,
+		"sub":  creds.Username,
+		"uid":  creds.UserID,
+		"role": creds.Role,
+		"jti":  jti,
+		"iat":  now.Unix(),
+		"exp":  now.Add(mfaChallengeTTL).Unix(),
+	})
+}
+
+func handleLoginMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, err.Error(), "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := validateTokenOfType(req.MFAToken, TokenTypeMFA)
+	if err != nil || revocations.IsRevoked(challenge) {
+		sendUnauthorized(w, "Invalid or expired MFA token")
+		return
+	}
+
+	ip := clientIP(r)
+	remaining, err := checkLockout(challenge.Username, ip)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if remaining > 0 {
+		recordAuthEvent(challenge.Username, ip, EventLoginLocked)
+		sendLocked(w, remaining)
+		return
+	}
+
+	var ok bool
+	if req.RecoveryCode != "" {
+		ok, err = useRecoveryCode(challenge.UserID, req.RecoveryCode)
+		if ok {
+			recordAuthEvent(challenge.Username, ip, EventRecoveryCodeUse)
+		}
+	} else {
+		ok, err = checkTOTP(challenge.UserID, req.Code)
+	}
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		recordAuthEvent(challenge.Username, ip, EventMFAFailed)
+		recordLoginFailure(challenge.Username, ip)
+		sendUnauthorized(w, "Invalid verification code")
+		return
+	}
+
+	// The challenge is single-use.
+	if err := revocations.RevokeToken(challenge, "mfa_completed"); err != nil {
+		log.Printf("Failed to revoke MFA challenge for %s: %v", challenge.Username, err)
+	}
+
+	var creds UserCredentials
+	err = db.QueryRowContext(r.Context(), "SELECT user_id, username, role FROM user_credentials WHERE user_id = $1", challenge.UserID).
+		Scan(&creds.UserID, &creds.Username, &creds.Role)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	recordLoginSuccess(creds.Username, ip)
+	completeLogin(w, r, loginGrant{UserCredentials: creds, MFA: true})
+}
+
+func handleMFAEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := requestClaims(r)
+	enabled, err := hasMFAEnabled(claims.UserID)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		sendError(w, "", "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		sendError(w, err.Error(), "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.ExecContext(r.Context(), `INSERT INTO user_mfa (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = 0, created_at = NOW()`,
+		claims.UserID, secret)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFAEnrollResponse{
+		Secret:          secret,
+		ProvisioningURI: provisioningURI(claims.Username, secret),
+	})
+}
+
+func handleMFAConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, err.Error(), "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims := requestClaims(r)
+	ok, err := checkTOTP(claims.UserID, req.Code)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		sendError(w, "", "Invalid verification code", http.StatusBadRequest)
+		return
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw, err := randomToken(5)
+		if err != nil {
+			sendError(w, err.Error(), "Failed to generate recovery codes", http.StatusInternalServerError)
+			return
+		}
+		codes[i] = raw[:5] + "-" + raw[5:]
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(r.Context(), "DELETE FROM mfa_recovery_codes WHERE user_id = $1", claims.UserID); err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	for _, code := range codes {
+		if _, err := tx.ExecContext(r.Context(), "INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)", claims.UserID, hashToken(code)); err != nil {
+			sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := tx.ExecContext(r.Context(), "UPDATE user_mfa SET enabled = TRUE, enabled_at = NOW() WHERE user_id = $1", claims.UserID); err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		sendError(w, err.Error(), "Failed to commit transaction", http.StatusInternalServerError)
+		return
+	}
+
+	recordAuthEvent(claims.Username, clientIP(r), EventMFAEnabled)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFAConfirmResponse{RecoveryCodes: codes})
+}
+
+func handleMFADisable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req MFADisableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, err.Error(), "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims := requestClaims(r)
+	if !confirmPassword(w, r, claims.Username, func() error {
+		_, err := authenticator.Authenticate(claims.Username, req.Password)
+		return err
+	}) {
+		return
+	}
+
+	ok, err := checkTOTP(claims.UserID, req.Code)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		sendError(w, "", "Invalid verification code", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.ExecContext(r.Context(), "DELETE FROM user_mfa WHERE user_id = $1", claims.UserID); err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.ExecContext(r.Context(), "DELETE FROM mfa_recovery_codes WHERE user_id = $1", claims.UserID); err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	recordAuthEvent(claims.Username, clientIP(r), EventMFADisabled)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyTOTP(t *testing.T) {
+	// The SHA-1 secret and codes of RFC 6238 appendix B, cut to six digits.
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		now      int64
+		lastStep int64
+		want     int64
+		ok       bool
+	}{
+		{"current step", secret, "287082", 59, 0, 1, true},
+		{"lower case secret", strings.ToLower(secret), "287082", 59, 0, 1, true},
+		{"previous step", secret, "081804", 1111111111, 0, 37037036, true},
+		{"current step after a previous code", secret, "050471", 1111111111, 37037036, 37037037, true},
+		{"replayed step", secret, "081804", 1111111111, 37037036, 0, false},
+		{"replayed current step", secret, "050471", 1111111111, 37037037, 0, false},
+		{"outside the skew", secret, "081804", 1111111109 + 3*totpPeriod, 0, 0, false},
+		{"wrong code", secret, "287083", 59, 0, 0, false},
+		{"short code", secret, "28708", 59, 0, 0, false},
+		{"invalid secret", "not base32!", "287082", 59, 0, 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := verifyTOTP(tt.secret, tt.code, time.Unix(tt.now, 0), tt.lastStep)
+		if step != tt.want || ok != tt.ok {
+			t.Errorf("%s: verifyTOTP = %d, %v, want %d, %v", tt.name, step, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -1,9 +1,36 @@
 package main
 
+import "time"
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// TokenClaims is the subset of access token claims the gateway relies on.
+type TokenClaims struct {
+	UserID int64
+	Username string
+	Role string
+	MFA bool
+	ID string
+	// Set for tokens issued by a direct login; see sessions.go.
+	SessionID string
+	Email string
+	IssuedAt time.Time
+	ExpiresAt time.Time
+	// Set for tokens issued to an OAuth client. Client credentials tokens
+	// have no UserID.
+	ClientID string
+	// Set when the caller authenticated with an API key instead of a JWT.
+	APIKeyID int64
+	Scopes []string
+}
+
 type UserCredentials struct {
 	UserID int64 `json:"userId"`
 	Username string `json:"username"`
-	PasswordHash string `json:"passwordHash"`
+	PasswordHash string `json:"-"`
+	Role string `json:"role"`
 }
 
 type LoginRequest struct {
@@ -13,10 +40,46 @@ type LoginRequest struct {
 
 type LoginResponse struct {
 	Token string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
 	Username string `json:"username"`
+	Role string `json:"role"`
 	ExpiresIn int `json:"expiresIn"`
 }
 
+type MFAChallengeResponse struct {
+	MFARequired bool `json:"mfaRequired"`
+	MFAToken string `json:"mfaToken"`
+	ExpiresIn int `json:"expiresIn"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfaToken"`
+	Code string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type MFAEnrollResponse struct {
+	Secret string `json:"secret"`
+	ProvisioningURI string `json:"provisioningUri"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+type MFAConfirmResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type MFADisableRequest struct {
+	Password string `json:"password"`
+	Code string `json:"code"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
 type RegisterRequest struct {
 	Username string `json:"username"`
 	Email string `json:"email"`
@@ -31,6 +94,11 @@ type UserResponse struct {
 	Email string `json:"email"`
 	FirstName string `json:"firstName"`
 	LastName string `json:"lastName"`
+	EmailVerified bool `json:"emailVerified"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
 }
 
 type ValidateRequest struct {
@@ -40,12 +108,256 @@ type ValidateRequest struct {
 type ValidateResponse struct {
 	Valid bool `json:"valid"`
 	Username string `json:"username,omitempty"`
+	Role string `json:"role,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type RevokeTokenRequest struct {
+	Token string `json:"token"`
+	Reason string `json:"reason"`
+}
+
+type RevokeUserTokensResponse struct {
+	UserID int64 `json:"userId"`
+	RevokedBefore time.Time `json:"revokedBefore"`
+}
+
+type SessionResponse struct {
+	ID string `json:"id"`
+	UserAgent string `json:"userAgent"`
+	IPAddress string `json:"ipAddress"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	Current bool `json:"current"`
+}
+
+type MeResponse struct {
+	UserID int64 `json:"userId"`
+	Username string `json:"username"`
+	Email string `json:"email"`
+	FirstName string `json:"firstName"`
+	LastName string `json:"lastName"`
+	EmailVerified bool `json:"emailVerified"`
+	Role string `json:"role"`
+	AuthSource string `json:"authSource"`
+	MFAEnabled bool `json:"mfaEnabled"`
+	// Whether the calling token was issued after a second factor.
+	MFAAuthenticated bool `json:"mfaAuthenticated"`
+	Session *SessionResponse `json:"session"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// Permission is a route pattern from the gateway policies and the methods
+// the caller may use on it. A path ending in "/*" covers everything below it.
+type Permission struct {
+	Path string `json:"path"`
+	Methods []string `json:"methods"`
+}
+
+// BreakerStatus is the circuit breaker state of one route. RetryAfter is in
+// seconds and only set while the breaker is open.
+type BreakerStatus struct {
+	Route string `json:"route"`
+	State string `json:"state"`
+	Failures int `json:"failures"`
+	OpenedAt *time.Time `json:"openedAt"`
+	RetryAfter int `json:"retryAfter,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+	Upstreams []UpstreamStatus `json:"upstreams"`
+}
+
+type UpstreamStatus struct {
+	URL string `json:"url"`
+	Healthy bool `json:"healthy"`
+	EjectedUntil *time.Time `json:"ejectedUntil"`
+	Active int64 `json:"active"`
+}
+
+// CheckResult is the outcome of one health check. LatencyMs is how long the
+// check took.
+type CheckResult struct {
+	Status string `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error string `json:"error,omitempty"`
+}
+
+// HealthResponse is the body of /healthz and /readyz, here and in the
+// services.
+type HealthResponse struct {
+	Status string `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// StatusResponse combines the state of the gateway's database and of every
+// routed service. Status is ok, degraded or unavailable.
+type StatusResponse struct {
+	Status string `json:"status"`
+	CheckedAt time.Time `json:"checkedAt"`
+	Database CheckResult `json:"database"`
+	Services []ServiceStatus `json:"services"`
+}
+
+type ServiceStatus struct {
+	Route string `json:"route"`
+	Status string `json:"status"`
+	Breaker string `json:"breaker"`
+	Upstreams []UpstreamCheck `json:"upstreams"`
+}
+
+// UpstreamCheck is the readiness of one service instance, with the checks
+// the instance reported.
+type UpstreamCheck struct {
+	URL string `json:"url"`
+	Status string `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
 	Error string `json:"error,omitempty"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+type SetRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+type LockoutResponse struct {
+	Subject string `json:"subject"`
+	LockoutCount int `json:"lockoutCount"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+type ForgotPasswordRequest struct {
+	Username string `json:"username"`
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name string `json:"name"`
+	UserID int64 `json:"userId"`
+	Scopes []string `json:"scopes"`
+	ExpiresInDays int `json:"expiresInDays"`
+}
+
+type APIKeyResponse struct {
+	ID int64 `json:"id"`
+	Name string `json:"name"`
+	Prefix string `json:"prefix"`
+	UserID int64 `json:"userId"`
+	Scopes []string `json:"scopes"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt *time.Time `json:"revokedAt"`
+	Key string `json:"key,omitempty"`
+}
+
+type OAuthClientRequest struct {
+	Name string `json:"name"`
+	RedirectURIs []string `json:"redirectUris"`
+	GrantTypes []string `json:"grantTypes"`
+	Scopes []string `json:"scopes"`
+	Public bool `json:"public"`
+}
+
+type OAuthClientResponse struct {
+	ClientID string `json:"clientId"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	Name string `json:"name"`
+	RedirectURIs []string `json:"redirectUris"`
+	GrantTypes []string `json:"grantTypes"`
+	Scopes []string `json:"scopes"`
+	Public bool `json:"public"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type OAuthConsentResponse struct {
+	ClientID string `json:"clientId"`
+	ClientName string `json:"clientName"`
+	Scopes []string `json:"scopes"`
+	GrantedAt time.Time `json:"grantedAt"`
+}
+
+// The OAuth and OpenID Connect payloads below use the snake_case field names
+// required by RFC 6749 and OpenID Connect Core.
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType string `json:"token_type"`
+	ExpiresIn int `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken string `json:"id_token,omitempty"`
+	Scope string `json:"scope,omitempty"`
+}
+
+type OAuthErrorResponse struct {
+	Error string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type OpenIDConfiguration struct {
+	Issuer string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	UserInfoEndpoint string `json:"userinfo_endpoint"`
+	JWKSURI string `json:"jwks_uri"`
+	ScopesSupported []string `json:"scopes_supported"`
+	ResponseTypesSupported []string `json:"response_types_supported"`
+	GrantTypesSupported []string `json:"grant_types_supported"`
+	SubjectTypesSupported []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported []string `json:"claims_supported"`
+}
+
+type UserInfoResponse struct {
+	Sub string `json:"sub"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Name string `json:"name,omitempty"`
+	GivenName string `json:"given_name,omitempty"`
+	FamilyName string `json:"family_name,omitempty"`
+	Email string `json:"email,omitempty"`
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
 	Message string `json:"message,omitempty"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError describes one invalid request field. Code is stable and meant
+// for clients; Message is for display.
+type FieldError struct {
+	Field string `json:"field"`
+	Code string `json:"code"`
+	Message string `json:"message"`
 }
 
 type CreateLoanRequest struct {
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifier delivers messages such as password reset and email verification
+// links to users.
+type Notifier interface {
+	Notify(to, subject, body string) error
+}
+
+// logNotifier writes messages to the gateway log. Only meant for local runs.
+type logNotifier struct{}
+
+func (logNotifier) Notify(to, subject, body string) error {
+	log.Printf("Notification to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// fileNotifier appends messages to a file, one block per message.
+type fileNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (n *fileNotifier) Notify(to, subject, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(time.RFC1123Z), to, subject, body)
+	return err
+}
+
+// smtpNotifier sends plain-text mail through an SMTP server. STARTTLS is used
+// when the server offers it; credentials are optional for local catchers
+// such as mailpit.
+type smtpNotifier struct {
+	host    string
+	addr    string
+	from    string
+	auth    smtp.Auth
+	timeout time.Duration
+}
+
+func (n *smtpNotifier) Notify(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("invalid header value")
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		n.from, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+
+	// smtp.SendMail has no timeouts; one deadline covers the whole exchange so
+	// a stalled server cannot hold on to the sender.
+	conn, err := net.DialTimeout("tcp", n.addr, n.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(n.timeout))
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: n.host}); err != nil {
+			return err
+		}
+	}
+	if n.auth != nil {
+		if err := c.Auth(n.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func newSMTPNotifier() *smtpNotifier {
+	host := getEnv("SMTP_HOST", "localhost")
+	n := &smtpNotifier{
+		host:    host,
+		addr:    net.JoinHostPort(host, getEnv("SMTP_PORT", "25")),
+		from:    getEnv("SMTP_FROM", "library@localhost"),
+		timeout: getEnvDuration("SMTP_TIMEOUT", 10*time.Second),
+	}
+	if username := getEnv("SMTP_USERNAME", ""); username != "" {
+		n.auth = smtp.PlainAuth("", username, getEnv("SMTP_PASSWORD", ""), host)
+	}
+	return n
+}
+
+func newNotifier() (Notifier, error) {
+	switch kind := getEnv("NOTIFIER", "log"); kind {
+	case "log":
+		return logNotifier{}, nil
+	case "file":
+		return &fileNotifier{path: getEnv("NOTIFIER_FILE", "notifications.log")}, nil
+	case "smtp":
+		return newSMTPNotifier(), nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", kind)
+	}
+}
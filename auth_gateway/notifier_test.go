@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSMTPNotifierTimesOut(t *testing.T) {
+	// A server that accepts the connection but never greets.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	n := &smtpNotifier{host: "127.0.0.1", addr: ln.Addr().String(), from: "library@localhost", timeout: 100 * time.Millisecond}
+	start := time.Now()
+	if err := n.Notify("bob@example.com", "Hello", "Hi"); err == nil {
+		t.Fatal("Notify succeeded against a silent server")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Notify took %s, want about the 100ms timeout", elapsed)
+	}
+}
@@ -0,0 +1,996 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+	GrantRefreshToken      = "refresh_token"
+)
+
+// oauthUserInfoPath is the only gateway endpoint outside /api that accepts
+// tokens issued to an OAuth client.
+const oauthUserInfoPath = "/oauth/userinfo"
+
+const (
+	EventOAuthAuthorized = "oauth_authorized"
+	EventOAuthDenied     = "oauth_denied"
+)
+
+// oidcScopes can be granted to clients acting for a user through the
+// authorization code flow. Client credentials grants use the API scopes from
+// apiScopes instead.
+var oidcScopes = map[string]string{
+	"openid":  "Confirm your identity",
+	"profile": "See your name and username",
+	"email":   "See your email address",
+}
+
+var (
+	oidcIssuer   = "http://localhost:8080"
+	oauthCodeTTL = 5 * time.Minute
+)
+
+func loadOAuthConfig() {
+	oidcIssuer = strings.TrimSuffix(getEnv("OIDC_ISSUER", oidcIssuer), "/")
+	oauthCodeTTL = getEnvDuration("OAUTH_CODE_TTL", oauthCodeTTL)
+}
+
+// oauthClient is a registered relying party. Public clients (SPAs, native
+// apps) have no secret and must rely on PKCE alone.
+type oauthClient struct {
+	ID           string
+	SecretHash   sql.NullString
+	Name         string
+	RedirectURIs []string
+	GrantTypes   []string
+	Scopes       []string
+	CreatedAt    time.Time
+}
+
+func (c *oauthClient) Public() bool {
+	return !c.SecretHash.Valid
+}
+
+func (c *oauthClient) response() OAuthClientResponse {
+	return OAuthClientResponse{
+		ClientID:     c.ID,
+		Name:         c.Name,
+		RedirectURIs: c.RedirectURIs,
+		GrantTypes:   c.GrantTypes,
+		Scopes:       c.Scopes,
+		Public:       c.Public(),
+		CreatedAt:    c.CreatedAt,
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func loadOAuthClient(clientID string) (*oauthClient, error) {
+	c := &oauthClient{}
+	var redirectURIs, grantTypes, scopes string
+	err := db.QueryRow(`SELECT client_id, secret_hash, name, redirect_uris, grant_types, scopes, created_at
+		FROM oauth_clients WHERE client_id = $1`, clientID).
+		Scan(&c.ID, &c.SecretHash, &c.Name, &redirectURIs, &grantTypes, &scopes, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	c.RedirectURIs = strings.Fields(redirectURIs)
+	c.GrantTypes = strings.Fields(grantTypes)
+	c.Scopes = strings.Fields(scopes)
+	return c, nil
+}
+
+// oauthError is reported to the client as an RFC 6749 error code.
+type oauthError struct {
+	Code        string
+	Description string
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func sendOAuthError(w http.ResponseWriter, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OAuthErrorResponse{Error: code, ErrorDescription: description})
+}
+
+// authorizeRequest holds the parameters of an authorization request. They are
+// carried through the consent form as hidden fields.
+type authorizeRequest struct {
+	Client              *oauthClient
+	ResponseType        string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// parseAuthorizeRequest validates an authorization request. If the client or
+// redirect URI cannot be trusted it returns a nil request and the error must
+// be shown to the user; any other error is sent back to the redirect URI.
+func parseAuthorizeRequest(form url.Values) (*authorizeRequest, error) {
+	client, err := loadOAuthClient(form.Get("client_id"))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("unknown client")
+	}
+	if err != nil {
+		log.Printf("Failed to load OAuth client: %v", err)
+		return nil, fmt.Errorf("client lookup failed")
+	}
+
+	redirectURI := form.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !contains(client.RedirectURIs, redirectURI) {
+		return nil, fmt.Errorf("redirect_uri is not registered for this client")
+	}
+
+	req := &authorizeRequest{
+		Client:              client,
+		ResponseType:        form.Get("response_type"),
+		RedirectURI:         redirectURI,
+		Scope:               form.Get("scope"),
+		State:               form.Get("state"),
+		Nonce:               form.Get("nonce"),
+		CodeChallenge:       form.Get("code_challenge"),
+		CodeChallengeMethod: form.Get("code_challenge_method"),
+	}
+
+	if req.ResponseType != "code" {
+		return req, &oauthError{"unsupported_response_type", "only response_type=code is supported"}
+	}
+	if !contains(client.GrantTypes, GrantAuthorizationCode) {
+		return req, &oauthError{"unauthorized_client", "client may not use the authorization code grant"}
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return req, &oauthError{"invalid_request", "PKCE with code_challenge_method=S256 is required"}
+	}
+	scopes := strings.Fields(req.Scope)
+	if len(scopes) == 0 {
+		return req, &oauthError{"invalid_scope", "scope is required"}
+	}
+	for _, scope := range scopes {
+		if _, ok := oidcScopes[scope]; !ok || !contains(client.Scopes, scope) {
+			return req, &oauthError{"invalid_scope", "scope " + scope + " is not allowed for this client"}
+		}
+	}
+	return req, nil
+}
+
+// redirect sends the user agent back to the client with the given
+// parameters and the request state.
+func (req *authorizeRequest) redirect(w http.ResponseWriter, r *http.Request, params url.Values) {
+	u, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		renderOAuthError(w, http.StatusBadRequest, "Invalid redirect URI")
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func (req *authorizeRequest) redirectError(w http.ResponseWriter, r *http.Request, e *oauthError) {
+	req.redirect(w, r, url.Values{"error": {e.Code}, "error_description": {e.Description}})
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in - Library</title>
+<style>
+body { font-family: sans-serif; background: #f4f4f4; }
+main { max-width: 380px; margin: 60px auto; padding: 24px; background: #fff; border-radius: 6px; }
+label { display: block; margin: 12px 0; }
+input { display: block; width: 100%; box-sizing: border-box; padding: 6px; }
+small { color: #666; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<main>
+<h1>Library account</h1>
+{{if .Client}}
+<p><strong>{{.Client}}</strong> would like to:</p>
+<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>
+{{end}}
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Client}}
+<form method="post" action="/oauth/authorize">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}
+<label>Username <input name="username" value="{{.Username}}" autocomplete="username" required></label>
+<label>Password <input type="password" name="password" autocomplete="current-password" required></label>
+<label>One-time code <input name="otp" autocomplete="one-time-code">
+<small>Only if two-factor authentication is enabled. A recovery code also works.</small></label>
+<button name="action" value="allow">Allow</button>
+<button name="action" value="deny" formnovalidate>Deny</button>
+</form>
+{{end}}
+</main>
+</body>
+</html>
+`))
+
+type consentPage struct {
+	Client   string
+	Scopes   []string
+	Params   map[string]string
+	Username string
+	Error    string
+}
+
+func renderConsent(w http.ResponseWriter, status int, req *authorizeRequest, username, message string) {
+	page := consentPage{
+		Client:   req.Client.Name,
+		Username: username,
+		Error:    message,
+		Params: map[string]string{
+			"client_id":             req.Client.ID,
+			"response_type":         req.ResponseType,
+			"redirect_uri":          req.RedirectURI,
+			"scope":                 req.Scope,
+			"state":                 req.State,
+			"nonce":                 req.Nonce,
+			"code_challenge":        req.CodeChallenge,
+			"code_challenge_method": req.CodeChallengeMethod,
+		},
+	}
+	for _, scope := range strings.Fields(req.Scope) {
+		page.Scopes = append(page.Scopes, oidcScopes[scope])
+	}
+	writeOAuthPage(w, status, page)
+}
+
+func renderOAuthError(w http.ResponseWriter, status int, message string) {
+	writeOAuthPage(w, status, consentPage{Error: message})
+}
+
+func writeOAuthPage(w http.ResponseWriter, status int, page consentPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// The page collects credentials, so it must never be framed.
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+	if err := consentTemplate.Execute(w, page); err != nil {
+		log.Printf("Failed to render OAuth page: %v", err)
+	}
+}
+
+// handleOAuthAuthorize shows the login and consent form on GET and processes
+// it on POST. On approval the user agent is redirected back to the client
+// with a single-use authorization code.
+func handleOAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		renderOAuthError(w, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	req, err := parseAuthorizeRequest(r.Form)
+	if req == nil {
+		renderOAuthError(w, http.StatusBadRequest, "Invalid authorization request: "+err.Error())
+		return
+	}
+	var oerr *oauthError
+	if errors.As(err, &oerr) {
+		req.redirectError(w, r, oerr)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		renderConsent(w, http.StatusOK, req, "", "")
+		return
+	}
+
+	username := r.PostForm.Get("username")
+	ip := clientIP(r)
+	if r.PostForm.Get("action") != "allow" {
+		recordAuthEvent(username, ip, EventOAuthDenied)
+		req.redirectError(w, r, &oauthError{"access_denied", "the user denied the request"})
+		return
+	}
+
+	remaining, err := checkLockout(username, ip)
+	if err != nil {
+		renderConsent(w, http.StatusInternalServerError, req, username, "Something went wrong, please try again")
+		return
+	}
+	if remaining > 0 {
+		recordAuthEvent(username, ip, EventLoginLocked)
+		renderConsent(w, http.StatusTooManyRequests, req, username,
+			fmt.Sprintf("Too many failed login attempts. Try again in %s.", remaining.Round(time.Second)))
+		return
+	}
+
+	creds, err := authenticator.Authenticate(username, r.PostForm.Get("password"))
+	if err == errInvalidCredentials {
+		recordLoginFailure(username, ip)
+		renderConsent(w, http.StatusUnauthorized, req, username, "Invalid username or password")
+		return
+	}
+	if err != nil {
+		renderConsent(w, http.StatusInternalServerError, req, username, "Something went wrong, please try again")
+		return
+	}
+
+	if emailVerificationMode == EmailVerificationLogin {
+		verified, err := isEmailVerified(creds.UserID)
+		if err != nil {
+			renderConsent(w, http.StatusInternalServerError, req, username, "Something went wrong, please try again")
+			return
+		}
+		if !verified {
+			renderConsent(w, http.StatusForbidden, req, username, "Please verify your email address before signing in")
+			return
+		}
+	}
+
+	mfaEnabled, err := hasMFAEnabled(creds.UserID)
+	if err != nil {
+		renderConsent(w, http.StatusInternalServerError, req, username, "Something went wrong, please try again")
+		return
+	}
+	if mfaEnabled {
+		otp := strings.TrimSpace(r.PostForm.Get("otp"))
+		ok, err := checkTOTP(creds.UserID, otp)
+		if err == nil && !ok && otp != "" {
+			ok, err = useRecoveryCode(creds.UserID, otp)
+			if ok {
+				recordAuthEvent(creds.Username, ip, EventRecoveryCodeUse)
+			}
+		}
+		if err != nil {
+			renderConsent(w, http.StatusInternalServerError, req, username, "Something went wrong, please try again")
+			return
+		}
+		if !ok {
+			recordAuthEvent(creds.Username, ip, EventMFAFailed)
+			recordLoginFailure(creds.Username, ip)
+			renderConsent(w, http.StatusUnauthorized, req, username, "Invalid or missing one-time code")
+			return
+		}
+	}
+
+	code, err := createAuthorizationCode(req, creds.UserID, mfaEnabled)
+	if err != nil {
+		log.Printf("Failed to create authorization code for %s: %v", creds.Username, err)
+		req.redirectError(w, r, &oauthError{"server_error", "failed to create authorization code"})
+		return
+	}
+
+	recordLoginSuccess(creds.Username, ip)
+	recordAuthEvent(creds.Username, ip, EventOAuthAuthorized)
+	req.redirect(w, r, url.Values{"code": {code}})
+}
+
+// createAuthorizationCode records the user's consent and stores a new code.
+// Only the hash of the code is kept.
+func createAuthorizationCode(req *authorizeRequest, userID int64, mfa bool) (string, error) {
+	code, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM oauth_auth_codes WHERE expires_at < NOW()"); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`INSERT INTO oauth_consents (user_id, client_id, scope) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, client_id) DO UPDATE SET scope = EXCLUDED.scope, granted_at = NOW()`,
+		userID, req.Client.ID, req.Scope)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`INSERT INTO oauth_auth_codes (code_hash, client_id, user_id, redirect_uri, scope, nonce, code_challenge, mfa, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		hashToken(code), req.Client.ID, userID, req.RedirectURI, req.Scope, req.Nonce, req.CodeChallenge, mfa, time.Now().Add(oauthCodeTTL))
+	if err != nil {
+		return "", err
+	}
+	return code, tx.Commit()
+}
+
+// authenticateClient identifies the client of a token request from HTTP Basic
+// credentials or the client_id/client_secret form fields. Public clients only
+// send their client_id.
+func authenticateClient(r *http.Request) (*oauthClient, error) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1: both parts are form-encoded.
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID == "" {
+		return nil, fmt.Errorf("missing client_id")
+	}
+
+	client, err := loadOAuthClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if client.Public() {
+		if secret != "" {
+			return nil, fmt.Errorf("public clients have no secret")
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.SecretHash.String)) != 1 {
+		return nil, fmt.Errorf("invalid client secret")
+	}
+	return client, nil
+}
+
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+func handleOAuthToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		sendOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form body")
+		return
+	}
+
+	client, err := authenticateClient(r)
+	if err != nil {
+		sendOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	var resp OAuthTokenResponse
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case GrantAuthorizationCode:
+		resp, err = exchangeAuthorizationCode(client, r.PostForm)
+	case GrantRefreshToken:
+		resp, err = refreshOAuthToken(client, r.PostForm.Get("refresh_token"))
+	case GrantClientCredentials:
+		resp, err = issueClientCredentials(client, r.PostForm.Get("scope"))
+	default:
+		err = &oauthError{"unsupported_grant_type", "unsupported grant_type " + grantType}
+	}
+
+	var oerr *oauthError
+	if errors.As(err, &oerr) {
+		sendOAuthError(w, http.StatusBadRequest, oerr.Code, oerr.Description)
+		return
+	}
+	if err != nil {
+		log.Printf("OAuth token request from client %s failed: %v", client.ID, err)
+		sendOAuthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// exchangeAuthorizationCode redeems a code for tokens. A code that is
+// presented twice revokes the tokens issued for it, as RFC 6749 section
+// 4.1.2 recommends.
+func exchangeAuthorizationCode(client *oauthClient, form url.Values) (OAuthTokenResponse, error) {
+	invalid := &oauthError{"invalid_grant", "invalid or expired authorization code"}
+	if !contains(client.GrantTypes, GrantAuthorizationCode) {
+		return OAuthTokenResponse{}, &oauthError{"unauthorized_client", "client may not use the authorization code grant"}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return OAuthTokenResponse{}, err
+	}
+	defer tx.Rollback()
+
+	codeHash := hashToken(form.Get("code"))
+	var clientID, redirectURI, nonce, challenge, familyID string
+	var createdAt, expiresAt time.Time
+	var usedAt sql.NullTime
+	grant := loginGrant{}
+	err = tx.QueryRow(`SELECT c.client_id, c.redirect_uri, c.scope, c.nonce, c.code_challenge, c.mfa, COALESCE(c.family_id, ''),
+			c.created_at, c.expires_at, c.used_at, uc.user_id, uc.username, uc.role
+		FROM oauth_auth_codes c JOIN user_credentials uc ON uc.user_id = c.user_id
+		WHERE c.code_hash = $1 FOR UPDATE OF c`, codeHash).
+		Scan(&clientID, &redirectURI, &grant.Scope, &nonce, &challenge, &grant.MFA, &familyID,
+			&createdAt, &expiresAt, &usedAt, &grant.UserID, &grant.Username, &grant.Role)
+	if err == sql.ErrNoRows {
+		return OAuthTokenResponse{}, invalid
+	}
+	if err != nil {
+		return OAuthTokenResponse{}, err
+	}
+
+	if usedAt.Valid {
+		if familyID != "" {
+			if err := revokeRefreshFamily(tx, familyID); err == nil {
+				tx.Commit()
+			}
+		}
+		return OAuthTokenResponse{}, invalid
+	}
+	if clientID != client.ID || redirectURI != form.Get("redirect_uri") || time.Now().After(expiresAt) {
+		return OAuthTokenResponse{}, invalid
+	}
+	if !verifyCodeChallenge(form.Get("code_verifier"), challenge) {
+		return OAuthTokenResponse{}, &oauthError{"invalid_grant", "code_verifier does not match the code challenge"}
+	}
+
+	grant.ClientID = client.ID
+	grant.FamilyID, err = newTokenFamilyID()
+	if err != nil {
+		return OAuthTokenResponse{}, err
+	}
+	if _, err := tx.Exec("UPDATE oauth_auth_codes SET used_at = NOW(), family_id = $2 WHERE code_hash = $1", codeHash, grant.FamilyID); err != nil {
+		return OAuthTokenResponse{}, err
+	}
+	tokens, err := issueTokens(tx, grant)
+	if err != nil {
+		return OAuthTokenResponse{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return OAuthTokenResponse{}, err
+	}
+	return oauthTokenResponse(grant, tokens, nonce, createdAt)
+}
+
+func refreshOAuthToken(client *oauthClient, refreshToken string) (OAuthTokenResponse, error) {
+	if !contains(client.GrantTypes, GrantAuthorizationCode) {
+		return OAuthTokenResponse{}, &oauthError{"unauthorized_client", "client may not use the refresh token grant"}
+	}
+	grant, tokens, err := rotateRefreshToken(refreshToken, client.ID)
+	switch err {
+	case nil:
+	case errRefreshTokenInvalid, errRefreshTokenRevoked, errRefreshTokenExpired:
+		return OAuthTokenResponse{}, &oauthError{"invalid_grant", err.Error()}
+	default:
+		return OAuthTokenResponse{}, err
+	}
+	return oauthTokenResponse(grant, tokens, "", time.Time{})
+}
+
+// oauthTokenResponse converts a gateway token pair and adds an ID token when
+// the openid scope was granted.
+func oauthTokenResponse(grant loginGrant, tokens LoginResponse, nonce string, authTime time.Time) (OAuthTokenResponse, error) {
+	resp := OAuthTokenResponse{
+		AccessToken:  tokens.Token,
+		TokenType:    "Bearer",
+		ExpiresIn:    tokens.ExpiresIn,
+		RefreshToken: tokens.RefreshToken,
+		Scope:        grant.Scope,
+	}
+	if contains(strings.Fields(grant.Scope), "openid") {
+		idToken, err := generateIDToken(grant, nonce, authTime)
+		if err != nil {
+			return OAuthTokenResponse{}, err
+		}
+		resp.IDToken = idToken
+	}
+	return resp, nil
+}
+
+// issueClientCredentials issues an access token to the client itself. It has
+// no user and no role, only API scopes, and comes without a refresh token.
+func issueClientCredentials(client *oauthClient, scope string) (OAuthTokenResponse, error) {
+	if client.Public() || !contains(client.GrantTypes, GrantClientCredentials) {
+		return OAuthTokenResponse{}, &oauthError{"unauthorized_client", "client may not use the client credentials grant"}
+	}
+
+	var scopes []string
+	if scope == "" {
+		for _, s := range client.Scopes {
+			if validScope(s) {
+				scopes = append(scopes, s)
+			}
+		}
+	} else {
+		scopes = strings.Fields(scope)
+		for _, s := range scopes {
+			if !validScope(s) || !contains(client.Scopes, s) {
+				return OAuthTokenResponse{}, &oauthError{"invalid_scope", "scope " + s + " is not allowed for this client"}
+			}
+		}
+	}
+	if len(scopes) == 0 {
+		return OAuthTokenResponse{}, &oauthError{"invalid_scope", "client has no API scopes"}
+	}
+
+	jti, err := randomToken(16)
+	if err != nil {
+		return OAuthTokenResponse{}, err
+	}
+	now := time.Now()
+	token, err := signJWT(jwt.MapClaims{
+		"typ":       TokenTypeAccess,
+		"sub":       client.ID,
+		"client_id": client.ID,
+		"scope":     strings.Join(scopes, " "),
+		"jti":       jti,
+		"iat":       now.Unix(),
+		"exp":       now.Add(accessTokenTTL).Unix(),
+		"iss":       oidcIssuer,
+	})
+	if err != nil {
+		return OAuthTokenResponse{}, err
+	}
+	return OAuthTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(accessTokenTTL.Seconds()),
+		Scope:       strings.Join(scopes, " "),
+	}, nil
+}
+
+// userInfo returns the OpenID Connect claims of a user that the granted
+// scopes allow. The subject is the user ID, which never changes.
+func userInfo(userID int64, scopes []string) (UserInfoResponse, error) {
+	var username, email, firstName, lastName string
+	err := db.QueryRow(`SELECT uc.username, u.email, COALESCE(u.first_name, ''), COALESCE(u.last_name, '')
+		FROM user_credentials uc JOIN users u ON u.id = uc.user_id WHERE uc.user_id = $1`, userID).
+		Scan(&username, &email, &firstName, &lastName)
+	if err != nil {
+		return UserInfoResponse{}, err
+	}
+
+	info := UserInfoResponse{Sub: strconv.FormatInt(userID, 10)}
+	if contains(scopes, "profile") {
+		info.PreferredUsername = username
+		info.GivenName = firstName
+		info.FamilyName = lastName
+		info.Name = strings.TrimSpace(firstName + " " + lastName)
+	}
+	if contains(scopes, "email") {
+		info.Email = email
+	}
+	return info, nil
+}
+
+func generateIDToken(grant loginGrant, nonce string, authTime time.Time) (string, error) {
+	info, err := userInfo(grant.UserID, strings.Fields(grant.Scope))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"typ": TokenTypeID,
+		"iss": oidcIssuer,
+		"sub": info.Sub,
+		"aud": grant.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(accessTokenTTL).Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if !authTime.IsZero() {
+		claims["auth_time"] = authTime.Unix()
+	}
+	for name, value := range map[string]string{
+		"preferred_username": info.PreferredUsername,
+		"name":               info.Name,
+		"given_name":         info.GivenName,
+		"family_name":        info.FamilyName,
+		"email":              info.Email,
+	} {
+		if value != "" {
+			claims[name] = value
+		}
+	}
+	return signJWT(claims)
+}
+
+func handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := requestClaims(r)
+	if claims.ClientID == "" || !contains(claims.Scopes, "openid") {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		sendOAuthError(w, http.StatusForbidden, "insufficient_scope", "the openid scope is required")
+		return
+	}
+
+	info, err := userInfo(claims.UserID, claims.Scopes)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(info)
+}
+
+func handleOpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scopes := append([]string{"openid", "profile", "email"}, apiScopes()...)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(OpenIDConfiguration{
+		Issuer:                            oidcIssuer,
+		AuthorizationEndpoint:             oidcIssuer + "/oauth/authorize",
+		TokenEndpoint:                     oidcIssuer + "/oauth/token",
+		UserInfoEndpoint:                  oidcIssuer + oauthUserInfoPath,
+		JWKSURI:                           oidcIssuer + "/.well-known/jwks.json",
+		ScopesSupported:                   scopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{GrantAuthorizationCode, GrantRefreshToken, GrantClientCredentials},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{signingKeys.Active().Method.Alg()},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username", "name", "given_name", "family_name", "email"},
+	})
+}
+
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" && u.Fragment == ""
+}
+
+func handleCreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	var req OAuthClientRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, err.Error(), "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" || len(req.GrantTypes) == 0 || len(req.Scopes) == 0 {
+		sendError(w, "", "Name, grant types and scopes are required", http.StatusBadRequest)
+		return
+	}
+	for _, grantType := range req.GrantTypes {
+		if grantType != GrantAuthorizationCode && grantType != GrantClientCredentials {
+			sendError(w, grantType, "Invalid grant type", http.StatusBadRequest)
+			return
+		}
+	}
+	if contains(req.GrantTypes, GrantClientCredentials) && req.Public {
+		sendError(w, "", "Public clients cannot use the client credentials grant", http.StatusBadRequest)
+		return
+	}
+	if contains(req.GrantTypes, GrantAuthorizationCode) && len(req.RedirectURIs) == 0 {
+		sendError(w, "", "At least one redirect URI is required", http.StatusBadRequest)
+		return
+	}
+	for _, uri := range req.RedirectURIs {
+		if !validRedirectURI(uri) {
+			sendError(w, uri, "Invalid redirect URI", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, scope := range req.Scopes {
+		if _, ok := oidcScopes[scope]; !ok && !validScope(scope) {
+			sendError(w, scope, "Invalid scope", http.StatusBadRequest)
+			return
+		}
+	}
+
+	clientID, err := randomToken(16)
+	if err != nil {
+		sendError(w, err.Error(), "Failed to generate client ID", http.StatusInternalServerError)
+		return
+	}
+	var secret string
+	var secretHash sql.NullString
+	if !req.Public {
+		if secret, err = randomToken(32); err != nil {
+			sendError(w, err.Error(), "Failed to generate client secret", http.StatusInternalServerError)
+			return
+		}
+		secretHash = sql.NullString{String: hashToken(secret), Valid: true}
+	}
+
+	client := &oauthClient{
+		ID:           clientID,
+		SecretHash:   secretHash,
+		Name:         req.Name,
+		RedirectURIs: req.RedirectURIs,
+		GrantTypes:   req.GrantTypes,
+		Scopes:       req.Scopes,
+	}
+	claims := requestClaims(r)
+	err = db.QueryRowContext(r.Context(), `INSERT INTO oauth_clients (client_id, secret_hash, name, redirect_uris, grant_types, scopes, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created_at`,
+		clientID, secretHash, req.Name, strings.Join(req.RedirectURIs, " "), strings.Join(req.GrantTypes, " "),
+		strings.Join(req.Scopes, " "), claims.UserID).Scan(&client.CreatedAt)
+	if err != nil {
+		sendError(w, err.Error(), "Failed to create OAuth client", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("OAuth client %s (%s) registered by %s", clientID, req.Name, claims.Username)
+	resp := client.response()
+	resp.ClientSecret = secret
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleListOAuthClients(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT client_id, secret_hash, name, redirect_uris, grant_types, scopes, created_at
+		FROM oauth_clients ORDER BY created_at`)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	clients := make([]OAuthClientResponse, 0)
+	for rows.Next() {
+		var c oauthClient
+		var redirectURIs, grantTypes, scopes string
+		if err := rows.Scan(&c.ID, &c.SecretHash, &c.Name, &redirectURIs, &grantTypes, &scopes, &c.CreatedAt); err != nil {
+			sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+			return
+		}
+		c.RedirectURIs = strings.Fields(redirectURIs)
+		c.GrantTypes = strings.Fields(grantTypes)
+		c.Scopes = strings.Fields(scopes)
+		clients = append(clients, c.response())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clients)
+}
+
+func handleOAuthClients(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleListOAuthClients(w, r)
+	case http.MethodPost:
+		handleCreateOAuthClient(w, r)
+	default:
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDeleteOAuthClient removes a client. Its codes, consents and refresh
+// tokens go with it; access tokens already issued run out on their own.
+func handleDeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientID := mux.Vars(r)["id"]
+	result, err := db.ExecContext(r.Context(), "DELETE FROM oauth_clients WHERE client_id = $1", clientID)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		sendError(w, "", "OAuth client not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("OAuth client %s deleted by %s", clientID, requestClaims(r).Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleListConsents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT c.client_id, oc.name, c.scope, c.granted_at
+		FROM oauth_consents c JOIN oauth_clients oc ON oc.client_id = c.client_id
+		WHERE c.user_id = $1 ORDER BY c.granted_at`, requestClaims(r).UserID)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	consents := make([]OAuthConsentResponse, 0)
+	for rows.Next() {
+		var c OAuthConsentResponse
+		var scope string
+		if err := rows.Scan(&c.ClientID, &c.ClientName, &scope, &c.GrantedAt); err != nil {
+			sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+			return
+		}
+		c.Scopes = strings.Fields(scope)
+		consents = append(consents, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(consents)
+}
+
+// handleRevokeConsent withdraws the caller's consent for a client and revokes
+// the refresh tokens that client holds for them.
+func handleRevokeConsent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := requestClaims(r)
+	clientID := mux.Vars(r)["clientId"]
+	result, err := db.ExecContext(r.Context(), "DELETE FROM oauth_consents WHERE user_id = $1 AND client_id = $2", claims.UserID, clientID)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		sendError(w, "", "Consent not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = db.ExecContext(r.Context(), "UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND client_id = $2 AND revoked_at IS NULL",
+		claims.UserID, clientID)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
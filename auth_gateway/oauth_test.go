@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestOAuthTokenScopes checks that tokens issued to OAuth clients only reach
+// what their scopes allow, whatever the role of the user behind them.
+func TestOAuthTokenScopes(t *testing.T) {
+	setupAuth(t)
+
+	admin := UserCredentials{UserID: 1, Username: "alice", Role: RoleAdmin}
+	// An authorization code flow token for a client the admin consented to
+	// with openid only.
+	codeFlowToken := accessToken(t, loginGrant{UserCredentials: admin, MFA: true, ClientID: "spa", Scope: "openid"})
+	clientToken := accessToken(t, loginGrant{
+		UserCredentials: UserCredentials{Username: "reporting"},
+		ClientID:        "reporting",
+		Scope:           "books:read",
+	})
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		want   int
+	}{
+		{"code flow token cannot read books", codeFlowToken, "GET", "/api/books", http.StatusForbidden},
+		{"code flow token cannot set roles", codeFlowToken, "PUT", "/admin/users/2/role", http.StatusForbidden},
+		{"code flow token cannot list sessions", codeFlowToken, "GET", "/auth/sessions", http.StatusForbidden},
+		{"code flow token reads userinfo", codeFlowToken, "GET", oauthUserInfoPath, http.StatusOK},
+		{"client reads books", clientToken, "GET", "/api/books", http.StatusOK},
+		{"client cannot write books", clientToken, "POST", "/api/books", http.StatusForbidden},
+		{"client cannot read userinfo", clientToken, "GET", oauthUserInfoPath, http.StatusForbidden},
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := jwtMiddleware(authorize(ok))
+			// The gateway's own /auth and /oauth endpoints have no policy.
+			if tt.path == "/auth/sessions" || tt.path == oauthUserInfoPath {
+				handler = jwtMiddleware(ok)
+			}
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d: %s", tt.method, tt.path, rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mJ92IY4HnSt4yVk6o5Ox3f9dPSPzQ0"
+	challenge := "SIs2dceSFWpICO2TghEzKB4B473ATgLWjlvrMN9rVq0"
+	tests := []struct {
+		name      string
+		verifier  string
+		challenge string
+		want      bool
+	}{
+		{"S256 match", verifier, challenge, true},
+		{"other verifier", strings.Replace(verifier, "d", "e", 1), challenge, false},
+		{"padded challenge", verifier, challenge + "=", false},
+		{"plain challenge", verifier, verifier, false},
+		{"empty", "", "", false},
+		{"shortest verifier", strings.Repeat("a", 43), "ZtNPunH49FD35FWYhT5Tv8I7vRKQJ8uxMaL0_9eHjNA", true},
+		{"verifier too short", strings.Repeat("a", 42), "elOGB_2quSlplZKfRRVlu7gULhhEEXMiqv0rPXawGv8", false},
+		{"longest verifier", strings.Repeat("a", 128), "aDbPE7rEAOkQUHHNavRwhN-srU5eMCyUv-0k4BOvtz4", true},
+		{"verifier too long", strings.Repeat("a", 129), "wSywJKLlVRzKDgj86PHF4xRVXMP-9jKe6ZSj23UhZq4", false},
+	}
+	for _, tt := range tests {
+		if got := verifyCodeChallenge(tt.verifier, tt.challenge); got != tt.want {
+			t.Errorf("%s: verifyCodeChallenge = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
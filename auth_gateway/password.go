@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	EventPasswordChanged        = "password_changed"
+	EventPasswordResetRequested = "password_reset_requested"
+	EventPasswordReset          = "password_reset"
+	EventPasswordResetFailed    = "password_reset_failed"
+)
+
+var (
+	passwordResetTTL = time.Hour
+	passwordResetURL = "http://localhost:8080/auth/password/reset"
+)
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// setPassword stores a new password hash. Callers are expected to revoke the
+// user's tokens afterwards so a leaked session cannot outlive the password.
+func setPassword(q queryer, userID int64, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("UPDATE user_credentials SET password_hash = $1, updated_at = NOW() WHERE user_id = $2", hash, userID)
+	return err
+}
+
+func handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, err.Error(), "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	claims := requestClaims(r)
+	var creds UserCredentials
+	var source, email string
+	err := db.QueryRowContext(r.Context(), `SELECT uc.user_id, uc.username, uc.password_hash, uc.role, uc.auth_source, u.email
+		FROM user_credentials uc JOIN users u ON u.id = uc.user_id WHERE uc.username = $1`, claims.Username).
+		Scan(&creds.UserID, &creds.Username, &creds.PasswordHash, &creds.Role, &source, &email)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if source != AuthSourceLocal {
+		sendError(w, "", "Password is managed by the "+source+" directory", http.StatusBadRequest)
+		return
+	}
+
+	if !confirmPassword(w, r, creds.Username, func() error {
+		if bcrypt.CompareHashAndPassword([]byte(creds.PasswordHash), []byte(req.CurrentPassword)) != nil {
+			return errInvalidCredentials
+		}
+		return nil
+	}) {
+		return
+	}
+	if fields := passwordRules.Check("newPassword", req.NewPassword, creds.Username, email); len(fields) > 0 {
+		sendValidationError(w, fields)
+		return
+	}
+
+	if err := setPassword(db, creds.UserID, req.NewPassword); err != nil {
+		sendError(w, err.Error(), "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+	if _, err := revocations.RevokeUser(creds.UserID, creds.Username); err != nil {
+		sendError(w, err.Error(), "Failed to revoke tokens", http.StatusInternalServerError)
+		return
+	}
+	recordAuthEvent(creds.Username, clientIP(r), EventPasswordChanged)
+
+	// Every older token is now revoked; hand out a fresh pair so the caller
+	// stays logged in on this device.
+	completeLogin(w, r, loginGrant{UserCredentials: creds, MFA: claims.MFA})
+}
+
+func handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, err.Error(), "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" && req.Email == "" {
+		sendError(w, "", "Username or email is required", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `SELECT uc.user_id, uc.username, u.email
+		FROM user_credentials uc JOIN users u ON u.id = uc.user_id
+		WHERE uc.auth_source = $3 AND (($1 <> '' AND uc.username = $1) OR ($2 <> '' AND LOWER(u.email) = LOWER($2)))`,
+		req.Username, req.Email, AuthSourceLocal)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	type account struct {
+		userID          int64
+		username, email string
+	}
+	var accounts []account
+	for rows.Next() {
+		var a account
+		if err := rows.Scan(&a.userID, &a.username, &a.email); err != nil {
+			rows.Close()
+			sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, a)
+	}
+	rows.Close()
+
+	// Sent in the background: waiting for the mail server would make known
+	// accounts answer measurably slower than unknown ones.
+	ip := clientIP(r)
+	go func() {
+		for _, a := range accounts {
+			if err := sendPasswordReset(a.userID, a.username, a.email); err != nil {
+				log.Printf("Failed to send password reset to %s: %v", a.username, err)
+				continue
+			}
+			recordAuthEvent(a.username, ip, EventPasswordResetRequested)
+		}
+	}()
+
+	// Same answer whether or not the account exists, so the endpoint cannot be
+	// used to discover usernames or addresses.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(MessageResponse{Message: "If the account exists, a reset link has been sent"})
+}
+
+// sendPasswordReset replaces any pending reset token of the user with a new
+// one and sends it through the notifier.
+func sendPasswordReset(userID int64, username, email string) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM password_reset_tokens WHERE user_id = $1 AND used_at IS NULL", userID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO password_reset_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		hashToken(token), userID, time.Now().Add(passwordResetTTL))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Hello %s,\n\nUse the following link to choose a new password. It expires in %s.\n\n%s?token=%s\n\nIf you did not ask for this, you can ignore this message.",
+		username, passwordResetTTL, passwordResetURL, token)
+	return notifier.Notify(email, "Library password reset", body)
+}
+
+// handleResetPassword serves the page the reset link opens (GET) and takes
+// the new password (POST), either as JSON or from that page's form.
+func handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeResetPasswordPage(w, http.StatusOK, resetPasswordPage{Token: r.URL.Query().Get("token")})
+		return
+	case http.MethodPost:
+	default:
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		req := ResetPasswordRequest{Token: r.PostFormValue("token"), NewPassword: r.PostFormValue("newPassword")}
+		if f := resetPassword(r, req); f != nil {
+			page := resetPasswordPage{Token: req.Token, Error: f.message}
+			for _, field := range f.fields {
+				page.Problems = append(page.Problems, field.Message)
+			}
+			writeResetPasswordPage(w, f.status, page)
+			return
+		}
+		writeResetPasswordPage(w, http.StatusOK, resetPasswordPage{Done: true})
+		return
+	}
+
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, err.Error(), "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if f := resetPassword(r, req); f != nil {
+		if len(f.fields) > 0 {
+			sendValidationError(w, f.fields)
+			return
+		}
+		sendError(w, f.err, f.message, f.status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MessageResponse{Message: "Password has been reset"})
+}
+
+// resetFailure is why a password reset was refused: a status and message
+// for the caller, the underlying error, and the field errors when the new
+// password breaks the policy.
+type resetFailure struct {
+	status  int
+	message string
+	err     string
+	fields  []FieldError
+}
+
+// resetPassword redeems the reset token and sets the new password.
+func resetPassword(r *http.Request, req ResetPasswordRequest) *resetFailure {
+	if req.Token == "" || req.NewPassword == "" {
+		return &resetFailure{status: http.StatusBadRequest, message: "Token and new password are required"}
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		return &resetFailure{status: http.StatusInternalServerError, message: "Database error", err: err.Error()}
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	var username, email string
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err = tx.QueryRowContext(r.Context(), `SELECT prt.user_id, uc.username, u.email, prt.expires_at, prt.used_at
+		FROM password_reset_tokens prt
+		JOIN user_credentials uc ON uc.user_id = prt.user_id
+		JOIN users u ON u.id = prt.user_id
+		WHERE prt.token_hash = $1 FOR UPDATE OF prt`, hashToken(req.Token)).
+		Scan(&userID, &username, &email, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows || (err == nil && (usedAt.Valid || time.Now().After(expiresAt))) {
+		recordAuthEvent(username, clientIP(r), EventPasswordResetFailed)
+		return &resetFailure{status: http.StatusBadRequest, message: "Invalid or expired reset token"}
+	}
+	if err != nil {
+		return &resetFailure{status: http.StatusInternalServerError, message: "Database error", err: err.Error()}
+	}
+	// Checked after the token so the policy cannot be probed without one; a
+	// rejected password leaves the token usable for another try.
+	if fields := passwordRules.Check("newPassword", req.NewPassword, username, email); len(fields) > 0 {
+		return &resetFailure{status: http.StatusBadRequest, message: "Please choose another password", fields: fields}
+	}
+
+	if _, err := tx.ExecContext(r.Context(), "UPDATE password_reset_tokens SET used_at = NOW() WHERE token_hash = $1", hashToken(req.Token)); err != nil {
+		return &resetFailure{status: http.StatusInternalServerError, message: "Database error", err: err.Error()}
+	}
+	if err := setPassword(tx, userID, req.NewPassword); err != nil {
+		return &resetFailure{status: http.StatusInternalServerError, message: "Failed to update password", err: err.Error()}
+	}
+	// The link was delivered to the account's address, which proves it works.
+	if _, err := tx.ExecContext(r.Context(), "UPDATE user_credentials SET email_verified_at = NOW() WHERE user_id = $1 AND email_verified_at IS NULL", userID); err != nil {
+		return &resetFailure{status: http.StatusInternalServerError, message: "Database error", err: err.Error()}
+	}
+	if err := tx.Commit(); err != nil {
+		return &resetFailure{status: http.StatusInternalServerError, message: "Failed to commit transaction", err: err.Error()}
+	}
+
+	if _, err := revocations.RevokeUser(userID, username); err != nil {
+		log.Printf("Failed to revoke tokens after password reset for %s: %v", username, err)
+	}
+	// The owner proved access to the mailbox, so lift any lockout as well.
+	if _, err := db.ExecContext(r.Context(), "DELETE FROM login_failures WHERE subject = $1", "user:"+username); err != nil {
+		log.Printf("Failed to clear lockout after password reset for %s: %v", username, err)
+	}
+	recordAuthEvent(username, clientIP(r), EventPasswordReset)
+	return nil
+}
+
+var resetPasswordTemplate = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Reset password - Library</title>
+<style>
+body { font-family: sans-serif; background: #f4f4f4; }
+main { max-width: 380px; margin: 60px auto; padding: 24px; background: #fff; border-radius: 6px; }
+label { display: block; margin: 12px 0; }
+input { display: block; width: 100%; box-sizing: border-box; padding: 6px; }
+.error { color: #b00020; }
+</style>
+</head>
+<body>
+<main>
+<h1>Reset password</h1>
+{{if .Done}}
+<p>Your password has been changed. You can now sign in with it.</p>
+{{else}}
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Problems}}<ul class="error">{{range .Problems}}<li>{{.}}</li>{{end}}</ul>{{end}}
+{{if .Token}}
+<form method="post" action="/auth/password/reset">
+<input type="hidden" name="token" value="{{.Token}}">
+<label>New password <input type="password" name="newPassword" autocomplete="new-password" required></label>
+<button>Change password</button>
+</form>
+{{else}}
+<p class="error">This link is incomplete. Please use the link from the email.</p>
+{{end}}
+{{end}}
+</main>
+</body>
+</html>
+`))
+
+type resetPasswordPage struct {
+	Token    string
+	Error    string
+	Problems []string
+	Done     bool
+}
+
+func writeResetPasswordPage(w http.ResponseWriter, status int, page resetPasswordPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// The reset token is in the URL; do not leak it to linked sites.
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+	if err := resetPasswordTemplate.Execute(w, page); err != nil {
+		log.Printf("Failed to render password reset page: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Character classes a password policy can require.
+const (
+	ClassLower  = "lower"
+	ClassUpper  = "upper"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+var classMessages = map[string]string{
+	ClassLower:  "Must contain a lowercase letter",
+	ClassUpper:  "Must contain an uppercase letter",
+	ClassDigit:  "Must contain a digit",
+	ClassSymbol: "Must contain a symbol",
+}
+
+// bcrypt ignores everything after 72 bytes, so longer passwords would give a
+// false sense of strength.
+const maxPasswordBytes = 72
+
+// passwordPolicy decides which new passwords are accepted. Breached passwords
+// are kept as upper-case SHA-1 hex, the format of the Have I Been Pwned
+// downloads, so plain and hashed lists can be mixed.
+type passwordPolicy struct {
+	MinLength       int
+	RequiredClasses []string
+	breached        map[string]bool
+}
+
+var passwordRules = &passwordPolicy{MinLength: 8}
+
+func loadPasswordPolicy() error {
+	p := &passwordPolicy{MinLength: getEnvInt("PASSWORD_MIN_LENGTH", 8)}
+	for _, class := range strings.Split(getEnv("PASSWORD_REQUIRED_CLASSES", ""), ",") {
+		if class = strings.TrimSpace(class); class == "" {
+			continue
+		}
+		if _, ok := classMessages[class]; !ok {
+			return fmt.Errorf("unknown character class %q in PASSWORD_REQUIRED_CLASSES", class)
+		}
+		p.RequiredClasses = append(p.RequiredClasses, class)
+	}
+	if path := getEnv("PASSWORD_BREACHED_FILE", ""); path != "" {
+		breached, err := loadBreachedPasswords(path)
+		if err != nil {
+			return err
+		}
+		p.breached = breached
+	}
+	passwordRules = p
+	return nil
+}
+
+// loadBreachedPasswords reads one password per line. Lines that are 40 hex
+// digits, optionally followed by ":count", are taken as SHA-1 hashes. Empty
+// lines and lines starting with # are skipped.
+func loadBreachedPasswords(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	breached := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); isSHA1Hex(hash) {
+			breached[strings.ToUpper(hash)] = true
+			continue
+		}
+		breached[sha1Hex(line)] = true
+	}
+	return breached, scanner.Err()
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// Check returns the problems with password for the given account. The
+// username and email are used to reject passwords built from them.
+func (p *passwordPolicy) Check(field, password, username, email string) []FieldError {
+	var errs []FieldError
+	add := func(code, message string) {
+		errs = append(errs, FieldError{Field: field, Code: code, Message: message})
+	}
+
+	if n := utf8.RuneCountInString(password); n < p.MinLength {
+		add("too_short", fmt.Sprintf("Must be at least %d characters", p.MinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		add("too_long", fmt.Sprintf("Must be at most %d bytes", maxPasswordBytes))
+	}
+
+	present := map[string]bool{}
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			present[ClassLower] = true
+		case unicode.IsUpper(r):
+			present[ClassUpper] = true
+		case unicode.IsDigit(r):
+			present[ClassDigit] = true
+		case !unicode.IsSpace(r):
+			present[ClassSymbol] = true
+		}
+	}
+	for _, class := range p.RequiredClasses {
+		if !present[class] {
+			add("missing_"+class, classMessages[class])
+		}
+	}
+
+	lower := strings.ToLower(password)
+	if len(username) >= 3 && strings.Contains(lower, strings.ToLower(username)) {
+		add("contains_username", "Must not contain the username")
+	}
+	if local, _, _ := strings.Cut(email, "@"); len(local) >= 3 && strings.Contains(lower, strings.ToLower(local)) {
+		add("contains_email", "Must not contain the email address")
+	}
+
+	if p.breached != nil && (p.breached[sha1Hex(password)] || p.breached[sha1Hex(lower)]) {
+		add("breached", "This password appears in a list of breached passwords; choose another one")
+	}
+	return errs
+}
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,50}$`)
+
+// validateRegistration checks every field of a registration request,
+// including the password policy, and returns all problems at once.
+func validateRegistration(req RegisterRequest) []FieldError {
+	var errs []FieldError
+	if !usernamePattern.MatchString(req.Username) {
+		errs = append(errs, FieldError{Field: "username", Code: "invalid_format",
+			Message: "Must be 3 to 50 letters, digits, dots, dashes or underscores"})
+	}
+	if addr, err := mail.ParseAddress(req.Email); err != nil || addr.Address != req.Email || len(req.Email) > 100 {
+		errs = append(errs, FieldError{Field: "email", Code: "invalid_format", Message: "Must be a valid email address"})
+	}
+	if len(req.FirstName) > 50 {
+		errs = append(errs, FieldError{Field: "firstName", Code: "too_long", Message: "Must be at most 50 characters"})
+	}
+	if len(req.LastName) > 50 {
+		errs = append(errs, FieldError{Field: "lastName", Code: "too_long", Message: "Must be at most 50 characters"})
+	}
+	return append(errs, passwordRules.Check("password", req.Password, req.Username, req.Email)...)
+}
+
+func sendValidationError(w http.ResponseWriter, fields []FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: "Validation failed", Fields: fields})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	breachedFile := filepath.Join(t.TempDir(), "breached.txt")
+	// "password1" in clear, "letmein" as an HIBP hash with a count.
+	content := "# test list\npassword1\n\n" + sha1Hex("letmein") + ":42\n"
+	if err := os.WriteFile(breachedFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	breached, err := loadBreachedPasswords(breachedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &passwordPolicy{MinLength: 10, RequiredClasses: []string{ClassUpper, ClassDigit}, breached: breached}
+
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+	}{
+		{"accepted", "Quiet-River-42", nil},
+		{"too short", "Short-1", []string{"too_short"}},
+		{"too long", "A1" + strings.Repeat("x", maxPasswordBytes), []string{"too_long"}},
+		{"length in characters", "Ünïcödé-Pä1", nil},
+		{"missing classes", "quiet-river-of-stars", []string{"missing_upper", "missing_digit"}},
+		{"contains username", "Alice-Springs-42", []string{"contains_username"}},
+		{"contains email", "Wonderland-Rabbit-7", []string{"contains_email"}},
+		{"breached password inside a longer one", "PASSWORD1-Aa", nil},
+		{"breached, any case", "Password1", []string{"too_short", "breached"}},
+		{"breached hash", "LetMeIn", []string{"too_short", "missing_digit", "breached"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var codes []string
+			for _, e := range p.Check("password", tt.password, "alice", "rabbit@example.com") {
+				if e.Field != "password" {
+					t.Errorf("field = %q, want password", e.Field)
+				}
+				codes = append(codes, e.Code)
+			}
+			if !slices.Equal(codes, tt.want) {
+				t.Errorf("Check(%q) = %v, want %v", tt.password, codes, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPasswordPolicyRejectsUnknownClass(t *testing.T) {
+	t.Setenv("PASSWORD_REQUIRED_CLASSES", "upper, emoji")
+	previous := passwordRules
+	if err := loadPasswordPolicy(); err == nil {
+		t.Fatal("unknown class accepted")
+	}
+	if passwordRules != previous {
+		t.Error("a failed load replaced the policy")
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestResetPasswordPage(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleResetPassword(rec, httptest.NewRequest("GET", "/auth/password/reset?token=a%22b", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("GET = %d %s, want an HTML page", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if body := rec.Body.String(); !strings.Contains(body, `name="token" value="a&#34;b"`) {
+		t.Errorf("page does not carry the escaped token:\n%s", body)
+	}
+
+	// A form without a new password is refused before the token is looked up.
+	form := url.Values{"token": {"abc"}}
+	req := httptest.NewRequest("POST", "/auth/password/reset", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	handleResetPassword(rec, req)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Token and new password are required") {
+		t.Errorf("POST form = %d:\n%s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// proxyFlushInterval bounds how long streamed answers sit in the gateway's
+// buffers before being flushed to the client.
+const proxyFlushInterval = 100 * time.Millisecond
+
+// credentialHeaders authenticate the caller to the gateway. Services get the
+// signed identity headers instead, so these are not passed on.
+var credentialHeaders = []string{"Authorization", "X-API-Key"}
+
+// newRouteProxy builds the reverse proxy of a route. Bodies are streamed in
+// both directions, and headers and status codes pass through unchanged
+// except for hop-by-hop and credential headers.
+func newRouteProxy(rt *route) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			for _, h := range credentialHeaders {
+				pr.Out.Header.Del(h)
+			}
+			forwardHeaders(pr.Out, pr.In)
+		},
+		Transport:     routeTransport{rt},
+		FlushInterval: proxyFlushInterval,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			sendUpstreamError(w, err, "Failed to contact service")
+		},
+	}
+}
+
+// routeTransport sends proxied requests through the route's upstream pool,
+// breaker and retries. A streamed body can only be sent once, so only
+// requests without a body are retried.
+type routeTransport struct {
+	route *route
+}
+
+func (t routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	idempotent := isIdempotent(req.Method) && (req.Body == nil || req.Body == http.NoBody)
+	return t.route.do(req.Context(), idempotent, func(target *url.URL) (*http.Request, error) {
+		out := req.Clone(req.Context())
+		out.URL.Scheme = target.Scheme
+		out.URL.Host = target.Host
+		out.URL.Path = target.Path + req.URL.Path
+		if req.URL.RawPath != "" {
+			out.URL.RawPath = target.Path + req.URL.RawPath
+		}
+		out.Host = ""
+		out.RequestURI = ""
+		signIdentity(out)
+		return out, nil
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+	"identity"
+)
+
+func TestProxyStripsCredentialsAndSignsIdentity(t *testing.T) {
+	setupAuth(t)
+	identitySigningKey = []byte("test-key")
+	t.Cleanup(func() { identitySigningKey = nil })
+
+	var got *http.Request
+	var gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got, gotBody = r, string(body)
+		w.Header().Set("Location", "/api/books/9")
+		w.Header().Set("X-Book-Version", "3")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id":9}`)
+	}))
+	defer upstream.Close()
+
+	var config routeConfig
+	err := yaml.Unmarshal([]byte(fmt.Sprintf(`
+routes:
+  - {name: books, prefix: /api/books, upstreams: [%s/v1]}`, upstream.URL)), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := buildRouteTable(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes.Store(table)
+	t.Cleanup(table.close)
+
+	token := accessToken(t, loginGrant{UserCredentials: UserCredentials{UserID: 2, Username: "bob", Role: RolePatron}})
+	req := httptest.NewRequest(http.MethodPost, "/api/books?draft=true", strings.NewReader(`{"title":"Go"}`))
+	req.RemoteAddr = "192.0.2.7:40000"
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(HeaderRequestID, "req-42")
+	// A client cannot claim another identity.
+	req.Header.Set(HeaderUserRoles, RoleAdmin)
+	req.Header.Set(HeaderIdentitySignature, "forged")
+	rec := httptest.NewRecorder()
+	requestIDMiddleware(http.HandlerFunc(serveRoute)).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated || rec.Body.String() != `{"id":9}` {
+		t.Fatalf("response = %d %s, want the upstream's 201", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("Location") != "/api/books/9" || rec.Header().Get("X-Book-Version") != "3" {
+		t.Errorf("upstream headers were not passed on: %v", rec.Header())
+	}
+	if got == nil {
+		t.Fatal("request did not reach the upstream")
+	}
+	if got.URL.Path != "/v1/api/books" || got.URL.RawQuery != "draft=true" || gotBody != `{"title":"Go"}` {
+		t.Errorf("upstream got %s?%s %q", got.URL.Path, got.URL.RawQuery, gotBody)
+	}
+	for _, h := range credentialHeaders {
+		if v := got.Header.Get(h); v != "" {
+			t.Errorf("%s reached the upstream: %q", h, v)
+		}
+	}
+	wantHeaders := map[string]string{
+		HeaderRequestID:     "req-42",
+		HeaderUserID:        "2",
+		HeaderUserName:      "bob",
+		HeaderUserRoles:     RolePatron,
+		"X-Forwarded-For":   "192.0.2.7",
+		"X-Forwarded-Proto": "http",
+	}
+	for h, want := range wantHeaders {
+		if v := got.Header.Get(h); v != want {
+			t.Errorf("upstream %s = %q, want %q", h, v, want)
+		}
+	}
+
+	// The signature covers the path the upstream sees, including the
+	// instance's base path.
+	if id, err := identity.Read(got, identitySigningKey); err != nil || !id.Verified {
+		t.Errorf("upstream could not verify the caller: %+v, %v", id, err)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// rateLimitSpec configures a route's token bucket: Requests tokens are added
+// every Per, and a caller can spend up to Burst (default Requests) at once.
+// Every caller gets its own bucket per route.
+type rateLimitSpec struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+	Burst    int           `yaml:"burst"`
+}
+
+func (s *rateLimitSpec) validate() error {
+	if s.Requests == 0 {
+		return nil
+	}
+	if s.Requests < 0 || s.Burst < 0 || s.Per < 0 {
+		return fmt.Errorf("rate limit values must be positive")
+	}
+	if s.Per == 0 {
+		s.Per = time.Minute
+	}
+	if s.Burst == 0 {
+		s.Burst = s.Requests
+	}
+	return nil
+}
+
+// rate returns the refill speed in tokens per second.
+func (s rateLimitSpec) rate() float64 {
+	return float64(s.Requests) / s.Per.Seconds()
+}
+
+// rateLimitResult describes a bucket after a request took from it.
+type rateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next token, if not allowed
+}
+
+func newRateLimitResult(spec rateLimitSpec, allowed bool, tokens float64) rateLimitResult {
+	rate := spec.rate()
+	res := rateLimitResult{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(spec.Burst) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return res
+}
+
+// rateLimitStore keeps the token buckets. Take spends one token from the
+// bucket named key, creating a full bucket if there is none.
+type rateLimitStore interface {
+	Take(ctx context.Context, key string, spec rateLimitSpec) (rateLimitResult, error)
+}
+
+var rateLimits rateLimitStore
+
+// memoryRateLimitStore keeps the buckets in process. Limits are per gateway
+// instance.
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // when the bucket is full and can be dropped
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*tokenBucket{}, lastSweep: time.Now()}
+}
+
+func (s *memoryRateLimitStore) Take(_ context.Context, key string, spec rateLimitSpec) (rateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		// A full bucket is the same as no bucket.
+		for k, b := range s.buckets {
+			if now.After(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	rate := spec.rate()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(spec.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(spec.Burst), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	res := newRateLimitResult(spec, allowed, b.tokens)
+	b.full = now.Add(res.Reset)
+	return res, nil
+}
+
+// redisRateLimitStore keeps the buckets in Redis so that every gateway
+// replica shares them. The refill runs in a script on Redis' clock, so the
+// replicas' clocks do not need to agree.
+type redisRateLimitStore struct {
+	client *redis.Client
+}
+
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or burst
+local updated = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+func newRedisRateLimitStore() (*redisRateLimitStore, error) {
+	opts, err := redis.ParseURL(getEnv("REDIS_URL", "redis://localhost:6379/0"))
+	if err != nil {
+		return nil, err
+	}
+	return &redisRateLimitStore{client: redis.NewClient(opts)}, nil
+}
+
+func (s *redisRateLimitStore) Take(ctx context.Context, key string, spec rateLimitSpec) (rateLimitResult, error) {
+	reply, err := takeTokenScript.Run(ctx, s.client, []string{key}, spec.rate(), spec.Burst).Slice()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	if len(reply) != 2 {
+		return rateLimitResult{}, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	allowed, _ := reply[0].(int64)
+	raw, _ := reply[1].(string)
+	tokens, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	return newRateLimitResult(spec, allowed == 1, tokens), nil
+}
+
+func newRateLimitStore() (rateLimitStore, error) {
+	switch kind := getEnv("RATE_LIMIT_STORE", "memory"); kind {
+	case "memory":
+		return newMemoryRateLimitStore(), nil
+	case "redis":
+		return newRedisRateLimitStore()
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", kind)
+	}
+}
+
+// rateLimitSubject names the caller a bucket belongs to: the API key, the
+// user (the JWT subject), the OAuth client, or else the client IP.
+func rateLimitSubject(r *http.Request) string {
+	if claims := requestClaims(r); claims != nil {
+		switch {
+		case claims.APIKeyID != 0:
+			return "apikey:" + strconv.FormatInt(claims.APIKeyID, 10)
+		case claims.Username != "":
+			return "user:" + claims.Username
+		case claims.ClientID != "":
+			return "client:" + claims.ClientID
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// limit enforces the route's rate limit. It must run after jwtMiddleware on
+// authenticated routes so callers are told apart by identity, not address.
+// If the store fails, requests are let through.
+func (rt *route) limit(next http.HandlerFunc) http.HandlerFunc {
+	if rt.rateLimit.Requests == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		spec := rt.rateLimit
+		key := "ratelimit:" + rt.Name + ":" + rateLimitSubject(r)
+		res, err := rateLimits.Take(r.Context(), key, spec)
+		if err != nil {
+			log.Printf("Rate limit check for %s failed, letting request through: %v", rt.Name, err)
+			next(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", spec.Requests, int(math.Ceil(spec.Per.Seconds())), spec.Burst))
+		h.Set("RateLimit-Limit", strconv.Itoa(spec.Burst))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+		if res.Allowed {
+			next(w, r)
+			return
+		}
+
+		retryAfter := retryAfterSeconds(res.RetryAfter)
+		h.Set("Retry-After", strconv.Itoa(retryAfter))
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Error:   "Too many requests",
+			Message: fmt.Sprintf("Rate limit for %s exceeded, try again in %ds", rt.Name, retryAfter),
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitSpecValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    rateLimitSpec
+		want    rateLimitSpec
+		wantErr bool
+	}{
+		{"no limit", rateLimitSpec{}, rateLimitSpec{}, false},
+		{"defaults", rateLimitSpec{Requests: 10}, rateLimitSpec{Requests: 10, Per: time.Minute, Burst: 10}, false},
+		{"explicit", rateLimitSpec{Requests: 10, Per: time.Second, Burst: 3}, rateLimitSpec{Requests: 10, Per: time.Second, Burst: 3}, false},
+		{"negative requests", rateLimitSpec{Requests: -1}, rateLimitSpec{}, true},
+		{"negative burst", rateLimitSpec{Requests: 10, Burst: -1}, rateLimitSpec{}, true},
+		{"negative period", rateLimitSpec{Requests: 10, Per: -time.Second}, rateLimitSpec{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := tt.spec
+			err := spec.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && spec != tt.want {
+				t.Errorf("validate() left %+v, want %+v", spec, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimitStoreTake(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	spec := rateLimitSpec{Requests: 2, Per: time.Second, Burst: 3}
+	take := func(key string) rateLimitResult {
+		t.Helper()
+		res, err := store.Take(context.Background(), key, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	// rewind moves the bucket's last refill back, as if d had passed.
+	rewind := func(key string, d time.Duration) {
+		store.buckets[key].updated = store.buckets[key].updated.Add(-d)
+	}
+
+	// A new bucket starts full, so the whole burst goes through.
+	for want := 2; want >= 0; want-- {
+		res := take("alice")
+		if !res.Allowed || res.Remaining != want {
+			t.Fatalf("burst: allowed %v, remaining %d; want allowed, remaining %d", res.Allowed, res.Remaining, want)
+		}
+	}
+	res := take("alice")
+	if res.Allowed {
+		t.Fatal("request past the burst was allowed")
+	}
+	// Two tokens a second: the next one is at most half a second away, and
+	// the bucket refills in a second and a half.
+	if res.RetryAfter <= 0 || res.RetryAfter > 500*time.Millisecond {
+		t.Errorf("RetryAfter = %v, want up to 500ms", res.RetryAfter)
+	}
+	if res.Reset <= time.Second || res.Reset > 1500*time.Millisecond {
+		t.Errorf("Reset = %v, want up to 1.5s", res.Reset)
+	}
+
+	if res := take("bob"); !res.Allowed || res.Remaining != 2 {
+		t.Errorf("other caller: allowed %v, remaining %d; want its own full bucket", res.Allowed, res.Remaining)
+	}
+
+	rewind("alice", time.Second)
+	if res := take("alice"); !res.Allowed || res.Remaining != 1 {
+		t.Errorf("after 1s: allowed %v, remaining %d; want allowed, remaining 1", res.Allowed, res.Remaining)
+	}
+
+	rewind("alice", time.Hour)
+	if res := take("alice"); !res.Allowed || res.Remaining != 2 {
+		t.Errorf("after an hour: remaining %d, want the burst capped at 3", res.Remaining)
+	}
+}
+
+func TestRouteLimit(t *testing.T) {
+	rateLimits = newMemoryRateLimitStore()
+	t.Cleanup(func() { rateLimits = nil })
+
+	rt := &route{Name: "books", rateLimit: rateLimitSpec{Requests: 1, Per: time.Minute, Burst: 1}}
+	handler := rt.limit(func(w http.ResponseWriter, r *http.Request) {})
+
+	steps := []struct {
+		wantStatus     int
+		wantRemaining  string
+		wantRetryAfter string
+	}{
+		{http.StatusOK, "0", ""},
+		{http.StatusTooManyRequests, "0", "60"},
+	}
+	for i, step := range steps {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/api/books", nil))
+		if w.Code != step.wantStatus {
+			t.Errorf("request %d: status %d, want %d", i+1, w.Code, step.wantStatus)
+		}
+		if got := w.Header().Get("RateLimit-Policy"); got != "1;w=60;burst=1" {
+			t.Errorf("request %d: RateLimit-Policy %q", i+1, got)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != step.wantRemaining {
+			t.Errorf("request %d: RateLimit-Remaining %q, want %q", i+1, got, step.wantRemaining)
+		}
+		if got := w.Header().Get("Retry-After"); got != step.wantRetryAfter {
+			t.Errorf("request %d: Retry-After %q, want %q", i+1, got, step.wantRetryAfter)
+		}
+	}
+}
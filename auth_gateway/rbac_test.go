@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// setupAuth installs a fresh signing key, an empty revocation store and the
+// route table from routes.yaml. Nothing here needs the database.
+func setupAuth(t *testing.T) {
+	t.Helper()
+	ring, err := newKeyRing(t.TempDir(), "EdDSA", time.Hour, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	signingKeys = ring
+	revocations = newRevocationStore(nil)
+
+	data, err := os.ReadFile("routes.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config routeConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	table, err := buildRouteTable(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes.Store(table)
+	t.Cleanup(func() {
+		routes.Store(nil)
+		table.close()
+	})
+}
+
+func accessToken(t *testing.T, grant loginGrant) string {
+	t.Helper()
+	token, err := generateJWT(grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRoutePolicyMatches(t *testing.T) {
+	tests := []struct {
+		policy routePolicy
+		method string
+		path   string
+		want   bool
+	}{
+		{routePolicy{Path: "/api/loans"}, "GET", "/api/loans", true},
+		{routePolicy{Path: "/api/loans"}, "GET", "/api/loans/1", false},
+		{routePolicy{Path: "/api/loans", Methods: []string{"POST"}}, "GET", "/api/loans", false},
+		{routePolicy{Path: "/api/loans/*"}, "GET", "/api/loans/1", true},
+		{routePolicy{Path: "/api/loans/*"}, "PUT", "/api/loans/1/return", true},
+		{routePolicy{Path: "/api/loans/*"}, "GET", "/api/loans", false},
+		{routePolicy{Path: "/api/loans/*"}, "GET", "/api/loans/", false},
+		{routePolicy{Path: "/api/loans/*"}, "GET", "/api/loans//", false},
+		{routePolicy{Path: "/api/loans/*"}, "GET", "/api/loansx", false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.matches(tt.method, tt.path); got != tt.want {
+			t.Errorf("%s.matches(%s %s) = %v, want %v", tt.policy.Path, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	setupAuth(t)
+
+	admin := UserCredentials{UserID: 1, Username: "alice", Role: RoleAdmin}
+	patron := UserCredentials{UserID: 2, Username: "bob", Role: RolePatron}
+	adminToken := accessToken(t, loginGrant{UserCredentials: admin, MFA: true})
+	patronToken := accessToken(t, loginGrant{UserCredentials: patron})
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		want   int
+	}{
+		{"patron reads books", patronToken, "GET", "/api/books", http.StatusOK},
+		{"patron cannot write books", patronToken, "POST", "/api/books", http.StatusForbidden},
+		{"patron cannot list users", patronToken, "GET", "/api/users", http.StatusForbidden},
+		{"patron cannot list loans", patronToken, "GET", "/api/loans", http.StatusForbidden},
+		{"patron cannot list loans with a trailing slash", patronToken, "GET", "/api/loans/", http.StatusForbidden},
+		{"patron reads a loan", patronToken, "GET", "/api/loans/7", http.StatusOK},
+		{"patron cannot set roles", patronToken, "PUT", "/admin/users/2/role", http.StatusForbidden},
+		{"admin sets roles", adminToken, "PUT", "/admin/users/2/role", http.StatusOK},
+		{"patron cannot read status", patronToken, "GET", "/status", http.StatusForbidden},
+		{"admin reads status", adminToken, "GET", "/status", http.StatusOK},
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := jwtMiddleware(authorize(ok))
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d: %s", tt.method, tt.path, rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestLoanListingIsStaffOnly(t *testing.T) {
+	setupAuth(t)
+	loans := currentRoutes().match("/api/loans")
+	patron := &TokenClaims{UserID: 2, Username: "bob", Role: RolePatron}
+
+	// A trailing slash is not the list.
+	req := httptest.NewRequest("GET", "/api/loans/", nil)
+	ctx := context.WithValue(req.Context(), routeContextKey, loans)
+	ctx = context.WithValue(ctx, claimsContextKey, patron)
+	rec := httptest.NewRecorder()
+	proxyLoans(rec, req.WithContext(ctx))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /api/loans/ = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	req = httptest.NewRequest("GET", "/api/loans", nil)
+	rec = httptest.NewRecorder()
+	handleGetAllLoans(rec, req.WithContext(context.WithValue(req.Context(), claimsContextKey, patron)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("patron listing all loans = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestLoanOwnership(t *testing.T) {
+	// The loan service knows loan 7 of bob (2) and loan 8 of carol (3).
+	owners := map[string]string{"7": "2", "8": "3"}
+	loanID := regexp.MustCompile(`<loanId>(\d+)</loanId>`)
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	soap := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		op := regexp.MustCompile(`<loan:(\w+)`).FindSubmatch(body)[1]
+		mu.Lock()
+		calls = append(calls, string(op))
+		mu.Unlock()
+		id := ""
+		if m := loanID.FindSubmatch(body); m != nil {
+			id = string(m[1])
+		}
+		fmt.Fprintf(w, `<Envelope><Body><%[1]sResponse><loan><id>%[2]s</id><userId>%[3]s</userId></loan></%[1]sResponse></Body></Envelope>`,
+			op, id, owners[id])
+	}))
+	defer soap.Close()
+
+	var config routeConfig
+	err := yaml.Unmarshal([]byte(fmt.Sprintf(`
+routes:
+  - {name: loans, prefix: /api/loans, upstreams: [%s], handler: loans}`, soap.URL)), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := buildRouteTable(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+	loans := table.match("/api/loans")
+
+	patron := &TokenClaims{UserID: 2, Username: "bob", Role: RolePatron}
+	librarian := &TokenClaims{UserID: 9, Username: "lena", Role: RoleLibrarian}
+	tests := []struct {
+		name      string
+		claims    *TokenClaims
+		method    string
+		path      string
+		body      string
+		want      int
+		wantCalls []string
+	}{
+		{"patron reads own loan", patron, "GET", "/api/loans/7", "", http.StatusOK, []string{"getLoanById"}},
+		{"patron reads other loan", patron, "GET", "/api/loans/8", "", http.StatusForbidden, []string{"getLoanById"}},
+		{"patron lists own loans", patron, "GET", "/api/loans/user/2", "", http.StatusOK, []string{"getLoansByUser"}},
+		{"patron lists other loans", patron, "GET", "/api/loans/user/3", "", http.StatusForbidden, nil},
+		{"patron returns own loan", patron, "PUT", "/api/loans/7/return", "", http.StatusOK, []string{"getLoanById", "returnLoan"}},
+		{"patron returns other loan", patron, "PUT", "/api/loans/8/return", "", http.StatusForbidden, []string{"getLoanById"}},
+		{"patron borrows for other", patron, "POST", "/api/loans", `{"userId":3,"bookId":1}`, http.StatusForbidden, nil},
+		{"librarian reads any loan", librarian, "GET", "/api/loans/8", "", http.StatusOK, []string{"getLoanById"}},
+		{"librarian returns any loan", librarian, "PUT", "/api/loans/8/return", "", http.StatusOK, []string{"returnLoan"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			calls = nil
+			mu.Unlock()
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			ctx := context.WithValue(req.Context(), routeContextKey, loans)
+			ctx = context.WithValue(ctx, claimsContextKey, tt.claims)
+			rec := httptest.NewRecorder()
+			proxyLoans(rec, req.WithContext(ctx))
+			if rec.Code != tt.want {
+				t.Errorf("%s %s = %d, want %d: %s", tt.method, tt.path, rec.Code, tt.want, rec.Body)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(calls, tt.wantCalls) {
+				t.Errorf("loan service calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
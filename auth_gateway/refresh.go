@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx so token helpers can run
+// inside or outside a transaction.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTokenFamilyID() (string, error) {
+	return randomToken(16)
+}
+
+// loginGrant describes who a token pair is issued to and how they logged in.
+// ClientID and Scope are only set for tokens issued to OAuth clients;
+// SessionID only for families started by a direct login.
+type loginGrant struct {
+	UserCredentials
+	FamilyID  string
+	SessionID string
+	MFA       bool
+	ClientID  string
+	Scope     string
+}
+
+// issueRefreshToken stores a new refresh token in the grant's family. Only the
+// SHA-256 hash is persisted; the raw token is returned to the caller once.
+func issueRefreshToken(q queryer, grant loginGrant) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = q.Exec(`INSERT INTO refresh_tokens (user_id, family_id, token_hash, mfa, client_id, scope, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)`,
+		grant.UserID, grant.FamilyID, hashToken(token), grant.MFA, grant.ClientID, grant.Scope, time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// issueTokens builds the access/refresh token pair returned by login and refresh.
+func issueTokens(q queryer, grant loginGrant) (LoginResponse, error) {
+	token, err := generateJWT(grant)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	refreshToken, err := issueRefreshToken(q, grant)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	return LoginResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		Username:     grant.Username,
+		Role:         grant.Role,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// revokeRefreshFamily revokes every token in the family and ends the session
+// it belongs to, if any.
+func revokeRefreshFamily(q queryer, familyID string) error {
+	_, err := q.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL", familyID)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", familyID)
+	return err
+}
+
+var (
+	errRefreshTokenInvalid = errors.New("invalid refresh token")
+	errRefreshTokenRevoked = errors.New("refresh token has been revoked")
+	errRefreshTokenExpired = errors.New("refresh token expired")
+)
+
+// rotateRefreshToken consumes a refresh token and issues the next pair in its
+// family. clientID must match the OAuth client the family was issued to, or be
+// empty for tokens from /auth/login.
+func rotateRefreshToken(refreshToken, clientID string) (loginGrant, LoginResponse, error) {
+	var grant loginGrant
+	tx, err := db.Begin()
+	if err != nil {
+		return grant, LoginResponse{}, err
+	}
+	defer tx.Rollback()
+
+	var tokenID int64
+	var expiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+	err = tx.QueryRow(`SELECT rt.id, rt.family_id, COALESCE(s.id, ''), rt.mfa, COALESCE(rt.client_id, ''), rt.scope,
+			rt.expires_at, rt.used_at, rt.revoked_at, uc.user_id, uc.username, uc.role
+		FROM refresh_tokens rt JOIN user_credentials uc ON uc.user_id = rt.user_id
+		LEFT JOIN sessions s ON s.id = rt.family_id
+		WHERE rt.token_hash = $1 FOR UPDATE OF rt`, hashToken(refreshToken)).
+		Scan(&tokenID, &grant.FamilyID, &grant.SessionID, &grant.MFA, &grant.ClientID, &grant.Scope,
+			&expiresAt, &usedAt, &revokedAt, &grant.UserID, &grant.Username, &grant.Role)
+	if err == sql.ErrNoRows || (err == nil && grant.ClientID != clientID) {
+		return grant, LoginResponse{}, errRefreshTokenInvalid
+	}
+	if err != nil {
+		return grant, LoginResponse{}, err
+	}
+
+	// A refresh token that was already rotated is being replayed: assume the
+	// family is compromised and revoke every token in it.
+	if usedAt.Valid || revokedAt.Valid {
+		if err := revokeRefreshFamily(tx, grant.FamilyID); err == nil {
+			tx.Commit()
+		}
+		return grant, LoginResponse{}, errRefreshTokenRevoked
+	}
+
+	if time.Now().After(expiresAt) {
+		return grant, LoginResponse{}, errRefreshTokenExpired
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1", tokenID); err != nil {
+		return grant, LoginResponse{}, err
+	}
+	if grant.SessionID != "" {
+		if _, err := tx.Exec("UPDATE sessions SET last_seen_at = NOW() WHERE id = $1", grant.SessionID); err != nil {
+			return grant, LoginResponse{}, err
+		}
+	}
+
+	resp, err := issueTokens(tx, grant)
+	if err != nil {
+		return grant, LoginResponse{}, err
+	}
+	return grant, resp, tx.Commit()
+}
+
+func handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		sendError(w, "", "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	_, resp, err := rotateRefreshToken(req.RefreshToken, "")
+	switch err {
+	case nil:
+	case errRefreshTokenInvalid:
+		sendUnauthorized(w, "Invalid refresh token")
+		return
+	case errRefreshTokenRevoked:
+		sendUnauthorized(w, "Refresh token has been revoked")
+		return
+	case errRefreshTokenExpired:
+		sendUnauthorized(w, "Refresh token expired")
+		return
+	default:
+		sendError(w, err.Error(), "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		sendError(w, "", "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var userID int64
+	var familyID string
+	err := db.QueryRowContext(r.Context(), "SELECT user_id, family_id FROM refresh_tokens WHERE token_hash = $1", hashToken(req.RefreshToken)).
+		Scan(&userID, &familyID)
+	if err != nil && err != sql.ErrNoRows {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil {
+		// Ending the session also rejects the other access tokens it issued;
+		// families without a session only need their refresh tokens revoked.
+		found, err := revocations.RevokeSession(userID, familyID)
+		if err == nil && !found {
+			err = revokeRefreshFamily(db, familyID)
+		}
+		if err != nil {
+			sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Also kill the access token if the client sent it along.
+	if claims, err := validateJWT(bearerToken(r)); err == nil {
+		if err := revocations.RevokeToken(claims, "logout"); err != nil {
+			log.Printf("Failed to revoke access token on logout: %v", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+	setupAuth(t)
+
+	now := time.Now()
+	// The columns rotateRefreshToken selects for a token of family "fam"
+	// issued to user 2 by a direct login.
+	token := func(clientID string, expiresAt time.Time, usedAt, revokedAt any) []driver.Value {
+		return []driver.Value{int64(1), "fam", "", false, clientID, "", expiresAt, usedAt, revokedAt, int64(2), "bob", RolePatron}
+	}
+	tests := []struct {
+		name     string
+		row      []driver.Value
+		clientID string
+		want     error
+		rotated  bool
+		revoked  bool
+	}{
+		{"unused token", token("", now.Add(time.Hour), nil, nil), "", nil, true, false},
+		{"unused client token", token("spa", now.Add(time.Hour), nil, nil), "spa", nil, true, false},
+		{"replayed token", token("", now.Add(time.Hour), now.Add(-time.Minute), nil), "", errRefreshTokenRevoked, false, true},
+		{"replayed expired token", token("", now.Add(-time.Hour), now.Add(-2*time.Hour), nil), "", errRefreshTokenRevoked, false, true},
+		{"revoked token", token("", now.Add(time.Hour), nil, now.Add(-time.Minute)), "", errRefreshTokenRevoked, false, true},
+		{"expired token", token("", now.Add(-time.Hour), nil, nil), "", errRefreshTokenExpired, false, false},
+		{"unknown token", nil, "", errRefreshTokenInvalid, false, false},
+		{"other client", token("spa", now.Add(time.Hour), nil, nil), "reporting", errRefreshTokenInvalid, false, false},
+		{"client token at /auth/refresh", token("spa", now.Add(time.Hour), nil, nil), "", errRefreshTokenInvalid, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDB{rows: []fakeRow{{"FROM refresh_tokens rt", tt.row}}}
+			openFakeDB(t, fake)
+
+			_, resp, err := rotateRefreshToken("raw-token", tt.clientID)
+			if err != tt.want {
+				t.Fatalf("rotateRefreshToken error = %v, want %v", err, tt.want)
+			}
+			if rotated := fake.ran("SET used_at = NOW()") && fake.ran("INSERT INTO refresh_tokens"); rotated != tt.rotated {
+				t.Errorf("rotated = %v, want %v", rotated, tt.rotated)
+			}
+			if tt.rotated && (resp.Token == "" || resp.RefreshToken == "") {
+				t.Errorf("rotation returned %+v, want a token pair", resp)
+			}
+			if revoked := fake.ran("WHERE family_id = $1 AND revoked_at IS NULL"); revoked != tt.revoked {
+				t.Errorf("family revoked = %v, want %v", revoked, tt.revoked)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// revocationStore keeps revoked token IDs, revoked sessions and per-user
+// revocation cut-offs in memory. Postgres is the source of truth; Sync
+// reloads it periodically so revocations made by other gateway replicas are
+// picked up.
+type revocationStore struct {
+	db       *sql.DB
+	mu       sync.RWMutex
+	tokens   map[string]time.Time // jti -> token expiry
+	sessions map[string]time.Time // session ID -> time it was revoked
+	users    map[string]time.Time // username -> tokens issued before this are revoked
+}
+
+func newRevocationStore(db *sql.DB) *revocationStore {
+	return &revocationStore{
+		db:       db,
+		tokens:   map[string]time.Time{},
+		sessions: map[string]time.Time{},
+		users:    map[string]time.Time{},
+	}
+}
+
+func (s *revocationStore) Load() error {
+	tokens := map[string]time.Time{}
+	rows, err := s.db.Query("SELECT jti, expires_at FROM revoked_tokens WHERE expires_at > NOW()")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jti string
+		var expiresAt time.Time
+		if err := rows.Scan(&jti, &expiresAt); err != nil {
+			return err
+		}
+		tokens[jti] = expiresAt
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Access tokens of a revoked session stop mattering once the last one
+	// issued before the revocation has expired.
+	sessions := map[string]time.Time{}
+	sessionRows, err := s.db.Query("SELECT id, revoked_at FROM sessions WHERE revoked_at > $1",
+		time.Now().Add(-accessTokenTTL))
+	if err != nil {
+		return err
+	}
+	defer sessionRows.Close()
+	for sessionRows.Next() {
+		var id string
+		var revokedAt time.Time
+		if err := sessionRows.Scan(&id, &revokedAt); err != nil {
+			return err
+		}
+		sessions[id] = revokedAt
+	}
+	if err := sessionRows.Err(); err != nil {
+		return err
+	}
+
+	users := map[string]time.Time{}
+	// Likewise a user cut-off once every token issued before it has expired.
+	userRows, err := s.db.Query(`SELECT uc.username, r.revoked_before
+		FROM user_token_revocations r JOIN user_credentials uc ON uc.user_id = r.user_id
+		WHERE r.revoked_before > $1`, time.Now().Add(-accessTokenTTL))
+	if err != nil {
+		return err
+	}
+	defer userRows.Close()
+	for userRows.Next() {
+		var username string
+		var revokedBefore time.Time
+		if err := userRows.Scan(&username, &revokedBefore); err != nil {
+			return err
+		}
+		users[username] = revokedBefore
+	}
+	if err := userRows.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.tokens = tokens
+	s.sessions = sessions
+	s.users = users
+	s.mu.Unlock()
+	return nil
+}
+
+// Sync purges expired entries and reloads the cache every interval.
+func (s *revocationStore) Sync(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := s.db.Exec("DELETE FROM revoked_tokens WHERE expires_at <= NOW()"); err != nil {
+			log.Printf("Failed to purge expired revocations: %v", err)
+		}
+		if _, err := s.db.Exec("DELETE FROM user_token_revocations WHERE revoked_before <= $1", time.Now().Add(-accessTokenTTL)); err != nil {
+			log.Printf("Failed to purge expired user revocations: %v", err)
+		}
+		// A session idle for longer than a refresh token lives cannot be
+		// resumed.
+		if _, err := s.db.Exec("DELETE FROM sessions WHERE last_seen_at < $1", time.Now().Add(-refreshTokenTTL)); err != nil {
+			log.Printf("Failed to purge expired sessions: %v", err)
+		}
+		if err := s.Load(); err != nil {
+			log.Printf("Failed to reload token revocations: %v", err)
+		}
+	}
+}
+
+func (s *revocationStore) IsRevoked(claims *TokenClaims) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if claims.ID != "" {
+		if _, ok := s.tokens[claims.ID]; ok {
+			return true
+		}
+	}
+	if claims.SessionID != "" {
+		if _, ok := s.sessions[claims.SessionID]; ok {
+			return true
+		}
+	}
+	if revokedBefore, ok := s.users[claims.Username]; ok && claims.IssuedAt.Before(revokedBefore) {
+		return true
+	}
+	return false
+}
+
+func (s *revocationStore) RevokeToken(claims *TokenClaims, reason string) error {
+	if claims.ID == "" {
+		return nil
+	}
+
+	_, err := s.db.Exec(`INSERT INTO revoked_tokens (jti, user_id, expires_at, reason)
+		VALUES ($1, (SELECT user_id FROM user_credentials WHERE username = $2), $3, $4)
+		ON CONFLICT (jti) DO NOTHING`,
+		claims.ID, claims.Username, claims.ExpiresAt, reason)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.tokens[claims.ID] = claims.ExpiresAt
+	s.mu.Unlock()
+	return nil
+}
+
+// RevokeUser invalidates every access token issued to the user so far, along
+// with all of their refresh tokens. Access tokens carry their issue time to
+// the microsecond and the cut-off is the next microsecond; the writes below
+// take far longer, so tokens the caller issues once this returns fall after
+// it.
+func (s *revocationStore) RevokeUser(userID int64, username string) (time.Time, error) {
+	revokedBefore := time.Now().Truncate(time.Microsecond).Add(time.Microsecond)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO user_token_revocations (user_id, revoked_before) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET revoked_before = EXCLUDED.revoked_before`,
+		userID, revokedBefore)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	_, err = tx.Exec("UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, err
+	}
+
+	s.mu.Lock()
+	s.users[username] = revokedBefore
+	s.mu.Unlock()
+	return revokedBefore, nil
+}
+
+// RevokeSession ends one of the user's sessions: its refresh tokens are
+// revoked and the access tokens it issued are rejected from now on. It
+// reports false if the user has no such active session.
+func (s *revocationStore) RevokeSession(userID int64, sessionID string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if err := revokeRefreshFamily(tx, sessionID); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	s.sessions[sessionID] = time.Now()
+	s.mu.Unlock()
+	return true, nil
+}
+
+// RevokeSessions ends every active session of the user except keep, which
+// may be empty, and returns how many were ended.
+func (s *revocationStore) RevokeSessions(userID int64, keep string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("UPDATE sessions SET revoked_at = NOW() WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL RETURNING id",
+		userID, keep)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err := revokeRefreshFamily(tx, id); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	for _, id := range ids {
+		s.sessions[id] = now
+	}
+	s.mu.Unlock()
+	return len(ids), nil
+}
+
+func handleRevokeSelf(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := revocations.RevokeToken(requestClaims(r), "self"); err != nil {
+		sendError(w, err.Error(), "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RevokeTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, err.Error(), "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := validateJWT(req.Token)
+	if err != nil {
+		// Expired tokens are already unusable; anything else is a bad request.
+		sendError(w, err.Error(), "Invalid token", http.StatusBadRequest)
+		return
+	}
+
+	if req.Reason == "" {
+		req.Reason = "admin"
+	}
+	if err := revocations.RevokeToken(claims, req.Reason); err != nil {
+		sendError(w, err.Error(), "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleRevokeUserTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		sendError(w, err.Error(), "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var username string
+	err = db.QueryRowContext(r.Context(), "SELECT username FROM user_credentials WHERE user_id = $1", userID).Scan(&username)
+	if err == sql.ErrNoRows {
+		sendError(w, "", "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	revokedBefore, err := revocations.RevokeUser(userID, username)
+	if err != nil {
+		sendError(w, err.Error(), "Failed to revoke tokens", http.StatusInternalServerError)
+		return
+	}
+	// Unlike a password or role change, this is meant to cut the user off
+	// entirely, machine clients included.
+	_, err = db.ExecContext(r.Context(), "UPDATE api_keys SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		sendError(w, err.Error(), "Failed to revoke API keys", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Revoked all tokens for user %d (%s)", userID, username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RevokeUserTokensResponse{
+		UserID:        userID,
+		RevokedBefore: revokedBefore,
+	})
+}
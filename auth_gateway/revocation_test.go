@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevokeUserCutoff(t *testing.T) {
+	setupAuth(t)
+	before := time.Now().Truncate(time.Microsecond)
+	claims, err := validateJWT(accessToken(t, loginGrant{UserCredentials: UserCredentials{UserID: 2, Username: "bob", Role: RolePatron}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// iat keeps the microseconds, so revocations within the same second
+	// can be told apart.
+	issuedAt := claims.IssuedAt
+	if issuedAt.Before(before) || issuedAt.After(time.Now()) {
+		t.Fatalf("iat = %s, want between %s and now", issuedAt, before)
+	}
+
+	tests := []struct {
+		name          string
+		revokedBefore time.Time
+		want          bool
+	}{
+		{"revoked a second later", issuedAt.Add(time.Second), true},
+		{"revoked a microsecond later", issuedAt.Add(time.Microsecond), true},
+		{"revoked as it was issued", issuedAt, false},
+		{"revoked a microsecond earlier", issuedAt.Add(-time.Microsecond), false},
+	}
+	for _, tt := range tests {
+		revocations.users["bob"] = tt.revokedBefore
+		if got := revocations.IsRevoked(claims); got != tt.want {
+			t.Errorf("%s: IsRevoked = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
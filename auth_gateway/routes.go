@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Auth requirements a route can declare. Public routes skip jwtMiddleware
+// and authorize entirely.
+const (
+	RouteAuthRequired = "required"
+	RouteAuthNone     = "none"
+)
+
+// RouteHandlerLoans serves the route with the REST-to-SOAP loan wrappers
+// instead of proxying it.
+const RouteHandlerLoans = "loans"
+
+const (
+	routeContextKey     contextKey = "route"
+	defaultRouteTimeout            = 10 * time.Second
+)
+
+var routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// routeConfig is the file format of ROUTES_FILE. JSON is accepted too, since
+// it is valid YAML.
+type routeConfig struct {
+	Routes []routeSpec `yaml:"routes"`
+}
+
+type routeSpec struct {
+	Name        string          `yaml:"name"`
+	Prefix      string          `yaml:"prefix"`
+	Upstreams   []string        `yaml:"upstreams"`
+	Balancer    string          `yaml:"balancer"`
+	HealthCheck healthCheckSpec `yaml:"health_check"`
+	Ejection    ejectionSpec    `yaml:"ejection"`
+	Breaker     breakerSpec     `yaml:"breaker"`
+	Retry       retrySpec       `yaml:"retry"`
+	RateLimit   rateLimitSpec   `yaml:"rate_limit"`
+	Cache       cacheSpec       `yaml:"cache"`
+	Handler     string          `yaml:"handler"`
+	Auth        string          `yaml:"auth"`
+	Methods     []string        `yaml:"methods"`
+	Timeout     time.Duration   `yaml:"timeout"`
+	Access      []accessSpec    `yaml:"access"`
+}
+
+// accessSpec grants the roles access to Path, a pattern in routePolicy
+// syntax. Without a Path it covers the whole route.
+type accessSpec struct {
+	Path    string   `yaml:"path"`
+	Methods []string `yaml:"methods"`
+	Roles   []string `yaml:"roles"`
+}
+
+// route is a validated routeSpec ready to serve requests.
+type route struct {
+	Name    string
+	Prefix  string
+	Handler string
+	Public  bool
+	Methods []string
+	Timeout time.Duration
+
+	pool    *upstreamPool
+	breaker *circuitBreaker
+	retry   retrySpec
+	// rateLimit is zero for routes without a limit.
+	rateLimit rateLimitSpec
+	// cache is nil for routes without caching.
+	cache        *responseCache
+	transport    *http.Transport
+	client       *http.Client
+	reverseProxy *httputil.ReverseProxy
+	serve        http.HandlerFunc
+}
+
+// routeTable is swapped as a whole on reload, so a request sees either the
+// old or the new configuration, never a mix.
+type routeTable struct {
+	routes   []*route // longest prefix first
+	policies []routePolicy
+}
+
+var (
+	routesFile = "routes.yaml"
+	routes     atomic.Pointer[routeTable]
+)
+
+func currentRoutes() *routeTable {
+	if t := routes.Load(); t != nil {
+		return t
+	}
+	return &routeTable{policies: adminPolicies}
+}
+
+// loadRoutes reads and validates the route file and installs it. On error
+// the previous table stays in place.
+func loadRoutes(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config routeConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	table, err := buildRouteTable(config)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, rt := range table.routes {
+		go rt.pool.runHealthChecks()
+	}
+	if old := routes.Swap(table); old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// close stops the health checks of a table that has been replaced and
+// drops its idle upstream connections.
+func (t *routeTable) close() {
+	for _, rt := range t.routes {
+		rt.pool.close()
+		rt.transport.CloseIdleConnections()
+	}
+}
+
+func buildRouteTable(config routeConfig) (*routeTable, error) {
+	if len(config.Routes) == 0 {
+		return nil, fmt.Errorf("no routes defined")
+	}
+
+	table := &routeTable{}
+	prefixes := map[string]bool{}
+	for i, spec := range config.Routes {
+		if spec.Name == "" {
+			spec.Name = fmt.Sprintf("route %d", i+1)
+		}
+		rt, policies, err := buildRoute(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.Name, err)
+		}
+		if prefixes[rt.Prefix] {
+			return nil, fmt.Errorf("%s: prefix %s is used by another route", rt.Name, rt.Prefix)
+		}
+		prefixes[rt.Prefix] = true
+		table.routes = append(table.routes, rt)
+		table.policies = append(table.policies, policies...)
+	}
+	for _, rt := range table.routes {
+		if rt.cache == nil {
+			continue
+		}
+		for _, name := range rt.cache.spec.InvalidatedBy {
+			if !slices.ContainsFunc(table.routes, func(other *route) bool { return other.Name == name }) {
+				return nil, fmt.Errorf("%s: cache invalidated_by names unknown route %q", rt.Name, name)
+			}
+		}
+	}
+	sort.SliceStable(table.routes, func(i, j int) bool {
+		return len(table.routes[i].Prefix) > len(table.routes[j].Prefix)
+	})
+	table.policies = append(table.policies, adminPolicies...)
+	return table, nil
+}
+
+func buildRoute(spec routeSpec) (*route, []routePolicy, error) {
+	rt := &route{
+		Name:    spec.Name,
+		Prefix:  strings.TrimSuffix(spec.Prefix, "/"),
+		Handler: spec.Handler,
+		Timeout: spec.Timeout,
+	}
+	if !strings.HasPrefix(rt.Prefix, "/") {
+		return nil, nil, fmt.Errorf("prefix must start with /")
+	}
+	if rt.Timeout == 0 {
+		rt.Timeout = defaultRouteTimeout
+	}
+	if rt.Timeout < 0 {
+		return nil, nil, fmt.Errorf("timeout must be positive")
+	}
+	rt.transport = http.DefaultTransport.(*http.Transport).Clone()
+	rt.transport.ResponseHeaderTimeout = rt.Timeout
+	rt.client = &http.Client{
+		Transport: tracingTransport(rt.Name, rt.transport),
+		// Redirects are the client's business; pass them on.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	rt.reverseProxy = newRouteProxy(rt)
+
+	switch spec.Handler {
+	case "", RouteHandlerLoans:
+	default:
+		return nil, nil, fmt.Errorf("unknown handler %q", spec.Handler)
+	}
+
+	var err error
+	rt.pool, err = newUpstreamPool(rt.Name, spec.Upstreams, spec.Balancer, spec.HealthCheck, spec.Ejection)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rt.breaker = newCircuitBreaker(rt.Name, spec.Breaker)
+	if spec.Retry.Attempts < 0 {
+		return nil, nil, fmt.Errorf("retry attempts must be positive")
+	}
+	rt.retry = spec.Retry
+	rt.retry.applyDefaults()
+
+	rt.rateLimit = spec.RateLimit
+	if err := rt.rateLimit.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	if spec.Cache.TTL < 0 || spec.Cache.MaxEntries < 0 {
+		return nil, nil, fmt.Errorf("cache values must be positive")
+	}
+	if spec.Cache.TTL > 0 {
+		// The loan wrappers check ownership per caller, so their answers
+		// cannot be shared.
+		if rt.Handler == RouteHandlerLoans {
+			return nil, nil, fmt.Errorf("cache is not supported with handler %s", RouteHandlerLoans)
+		}
+		rt.cache = newResponseCache(spec.Cache)
+	} else if len(spec.Cache.InvalidatedBy) > 0 {
+		return nil, nil, fmt.Errorf("cache invalidated_by needs a ttl")
+	}
+
+	if rt.Methods, err = normalizeMethods(spec.Methods); err != nil {
+		return nil, nil, err
+	}
+	if len(rt.Methods) == 0 {
+		rt.Methods = routeMethods
+	}
+
+	switch spec.Auth {
+	case "", RouteAuthRequired:
+	case RouteAuthNone:
+		rt.Public = true
+		if len(spec.Access) > 0 {
+			return nil, nil, fmt.Errorf("access rules need auth: %s", RouteAuthRequired)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown auth %q", spec.Auth)
+	}
+
+	policies, err := routeAccessPolicies(rt, spec.Access)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	handler := rt.cached(rt.proxy)
+	if rt.Handler == RouteHandlerLoans {
+		handler = rt.cached(proxyLoans)
+	}
+	if rt.Public {
+		rt.serve = rt.limit(handler)
+	} else {
+		rt.serve = jwtMiddleware(rt.limit(authorize(handler)))
+	}
+	return rt, policies, nil
+}
+
+// routeAccessPolicies turns the access rules of an authenticated route into
+// routePolicy entries. A route without rules is open to every role.
+func routeAccessPolicies(rt *route, access []accessSpec) ([]routePolicy, error) {
+	if rt.Public {
+		return nil, nil
+	}
+	if len(access) == 0 {
+		access = []accessSpec{{Roles: allRoles}}
+	}
+
+	var policies []routePolicy
+	for _, a := range access {
+		methods, err := normalizeMethods(a.Methods)
+		if err != nil {
+			return nil, err
+		}
+		if len(a.Roles) == 0 {
+			return nil, fmt.Errorf("access rule without roles")
+		}
+		for _, role := range a.Roles {
+			if !validRoles[role] {
+				return nil, fmt.Errorf("unknown role %q", role)
+			}
+		}
+
+		paths := []string{rt.Prefix, rt.Prefix + "/*"}
+		if a.Path != "" {
+			base := strings.TrimSuffix(a.Path, "/*")
+			if base != rt.Prefix && !strings.HasPrefix(base, rt.Prefix+"/") {
+				return nil, fmt.Errorf("access path %s is outside prefix %s", a.Path, rt.Prefix)
+			}
+			paths = []string{a.Path}
+		}
+		for _, path := range paths {
+			policies = append(policies, routePolicy{Path: path, Methods: methods, Roles: a.Roles})
+		}
+	}
+	return policies, nil
+}
+
+func normalizeMethods(methods []string) ([]string, error) {
+	var result []string
+	for _, m := range methods {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if !contains(routeMethods, m) {
+			return nil, fmt.Errorf("unsupported method %q", m)
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+// match returns the route with the longest prefix covering path.
+func (t *routeTable) match(path string) *route {
+	for _, rt := range t.routes {
+		if path == rt.Prefix || strings.HasPrefix(path, rt.Prefix+"/") {
+			return rt
+		}
+	}
+	return nil
+}
+
+func (t *routeTable) findPolicy(method, path string) *routePolicy {
+	for i := range t.policies {
+		if t.policies[i].matches(method, path) {
+			return &t.policies[i]
+		}
+	}
+	return nil
+}
+
+// proxy streams the request to an upstream under the same path.
+func (rt *route) proxy(w http.ResponseWriter, r *http.Request) {
+	rt.reverseProxy.ServeHTTP(w, r)
+}
+
+// requestRoute returns the route serveRoute matched for the request.
+func requestRoute(r *http.Request) *route {
+	rt, _ := r.Context().Value(routeContextKey).(*route)
+	return rt
+}
+
+// serveRoute dispatches every request that no built-in gateway endpoint
+// handles to the configured route table.
+func serveRoute(w http.ResponseWriter, r *http.Request) {
+	rt := currentRoutes().match(r.URL.Path)
+	if rt == nil {
+		sendError(w, "", "Not found", http.StatusNotFound)
+		return
+	}
+	if !contains(rt.Methods, r.Method) {
+		w.Header().Set("Allow", strings.Join(rt.Methods, ", "))
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), routeContextKey, rt)
+	rt.serve(w, r.WithContext(ctx))
+}
+
+// watchRouteReloads reloads the route file whenever the process receives
+// SIGHUP. A broken file is logged and ignored.
+func watchRouteReloads(path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := loadRoutes(path); err != nil {
+			log.Printf("Keeping previous routes, reload failed: %v", err)
+			continue
+		}
+		log.Printf("Reloaded %d routes from %s", len(currentRoutes().routes), path)
+	}
+}
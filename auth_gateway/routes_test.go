@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildRouteTableRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{"no routes", `routes: []`, "no routes defined"},
+		{"relative prefix", `
+routes:
+  - {name: books, prefix: api/books, upstreams: [http://books]}`, "prefix must start with /"},
+		{"shared prefix", `
+routes:
+  - {name: books, prefix: /api/books, upstreams: [http://books]}
+  - {name: more-books, prefix: /api/books/, upstreams: [http://books]}`, "prefix /api/books is used by another route"},
+		{"no upstreams", `
+routes:
+  - {name: books, prefix: /api/books}`, "at least one upstream is required"},
+		{"bad upstream", `
+routes:
+  - {name: books, prefix: /api/books, upstreams: [books:8081]}`, "invalid upstream"},
+		{"unknown handler", `
+routes:
+  - {name: books, prefix: /api/books, upstreams: [http://books], handler: soap}`, `unknown handler "soap"`},
+		{"unknown auth", `
+routes:
+  - {name: books, prefix: /api/books, upstreams: [http://books], auth: optional}`, `unknown auth "optional"`},
+		{"unknown method", `
+routes:
+  - {name: books, prefix: /api/books, upstreams: [http://books], methods: [TRACE]}`, `unsupported method "TRACE"`},
+		{"access on public route", `
+routes:
+  - name: books
+    prefix: /api/books
+    upstreams: [http://books]
+    auth: none
+    access: [{roles: [patron]}]`, "access rules need auth"},
+		{"unknown role", `
+routes:
+  - name: books
+    prefix: /api/books
+    upstreams: [http://books]
+    access: [{roles: [reader]}]`, `unknown role "reader"`},
+		{"access outside prefix", `
+routes:
+  - name: books
+    prefix: /api/books
+    upstreams: [http://books]
+    access: [{path: /api/users/*, roles: [admin]}]`, "outside prefix"},
+		{"negative rate limit", `
+routes:
+  - name: books
+    prefix: /api/books
+    upstreams: [http://books]
+    rate_limit: {requests: -1}`, "rate limit values must be positive"},
+		{"cached loans handler", `
+routes:
+  - name: loans
+    prefix: /api/loans
+    upstreams: [http://loans]
+    handler: loans
+    cache: {ttl: 30s}`, "cache is not supported"},
+		{"invalidated by unknown route", `
+routes:
+  - name: books
+    prefix: /api/books
+    upstreams: [http://books]
+    cache: {ttl: 30s, invalidated_by: [loans]}`, `unknown route "loans"`},
+		{"invalidated by without ttl", `
+routes:
+  - name: books
+    prefix: /api/books
+    upstreams: [http://books]
+    cache: {invalidated_by: [books]}`, "needs a ttl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeRoutes(t, tt.yaml)
+			err := loadRoutes(path)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadRoutes error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRouteTableMatch(t *testing.T) {
+	path := writeRoutes(t, `
+routes:
+  - {name: books, prefix: /api/books, upstreams: [http://books]}
+  - {name: covers, prefix: /api/books/covers/, upstreams: [http://covers], auth: none}
+  - {name: users, prefix: /api/users, upstreams: [http://users]}`)
+	if err := loadRoutes(path); err != nil {
+		t.Fatal(err)
+	}
+	table := currentRoutes()
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/books", "books"},
+		{"/api/books/12", "books"},
+		{"/api/books/covers", "covers"},
+		{"/api/books/covers/12.jpg", "covers"},
+		{"/api/bookshelf", ""},
+		{"/api/users/3", "users"},
+		{"/api", ""},
+		{"/", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if rt := table.match(tt.path); rt != nil {
+			got = rt.Name
+		}
+		if got != tt.want {
+			t.Errorf("match(%s) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	covers := table.match("/api/books/covers")
+	if !covers.Public || covers.Timeout != defaultRouteTimeout || len(covers.Methods) != len(routeMethods) {
+		t.Errorf("covers defaults: public %v, timeout %v, methods %v", covers.Public, covers.Timeout, covers.Methods)
+	}
+	// Routes without access rules are open to every role.
+	if p := table.findPolicy("DELETE", "/api/users/3"); p == nil || len(p.Roles) != len(allRoles) {
+		t.Errorf("users policy = %+v, want every role", p)
+	}
+}
+
+func TestLoadRoutesKeepsPreviousTableOnError(t *testing.T) {
+	path := writeRoutes(t, `
+routes:
+  - {name: books, prefix: /api/books, upstreams: [http://books]}`)
+	if err := loadRoutes(path); err != nil {
+		t.Fatal(err)
+	}
+	first := currentRoutes()
+
+	if err := os.WriteFile(path, []byte("routes: [{name: books, prefix: /api/books}]"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadRoutes(path); err == nil {
+		t.Fatal("invalid reload succeeded")
+	}
+	if currentRoutes() != first {
+		t.Fatal("invalid reload replaced the route table")
+	}
+
+	if err := os.WriteFile(path, []byte("routes: [{name: books, prefix: /api/books, upstreams: [http://books-2]}]"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadRoutes(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentRoutes().match("/api/books").pool.targets[0].URL.Host; got != "books-2" {
+		t.Errorf("reloaded upstream = %s, want books-2", got)
+	}
+	select {
+	case <-first.routes[0].pool.stop:
+	default:
+		t.Error("replaced table was not closed")
+	}
+}
+
+// writeRoutes writes a route file and restores the empty table when the
+// test ends.
+func writeRoutes(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if old := routes.Swap(nil); old != nil {
+			old.close()
+		}
+	})
+	return path
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const EventSessionRevoked = "session_revoked"
+
+// maxUserAgentLength keeps a hostile client from filling the sessions table.
+const maxUserAgentLength = 512
+
+// A session is one login on one device. Its ID is the refresh token family
+// started by that login and is carried in the sid claim of every access
+// token the family produces, so revoking the session stops both.
+func createSession(q queryer, sessionID string, userID int64, r *http.Request) error {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+	_, err := q.Exec("INSERT INTO sessions (id, user_id, user_agent, client_ip) VALUES ($1, $2, $3, $4)",
+		sessionID, userID, userAgent, clientIP(r))
+	return err
+}
+
+// sessionTouchInterval bounds how often a busy session writes last_seen_at.
+const sessionTouchInterval = time.Minute
+
+// sessionActivity remembers when each session's last_seen_at was last
+// written so authenticated requests only hit the database once per interval.
+type sessionActivity struct {
+	mu        sync.Mutex
+	touched   map[string]time.Time
+	lastPrune time.Time
+}
+
+var activity = &sessionActivity{touched: map[string]time.Time{}}
+
+func (a *sessionActivity) Touch(sessionID string) {
+	if sessionID == "" {
+		return
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	if last, ok := a.touched[sessionID]; ok && now.Sub(last) < sessionTouchInterval {
+		a.mu.Unlock()
+		return
+	}
+	a.touched[sessionID] = now
+	if now.Sub(a.lastPrune) >= sessionTouchInterval {
+		for id, last := range a.touched {
+			if now.Sub(last) >= sessionTouchInterval {
+				delete(a.touched, id)
+			}
+		}
+		a.lastPrune = now
+	}
+	a.mu.Unlock()
+
+	go func() {
+		if _, err := db.Exec("UPDATE sessions SET last_seen_at = NOW() WHERE id = $1", sessionID); err != nil {
+			log.Printf("Failed to update session %s: %v", sessionID, err)
+		}
+	}()
+}
+
+// handleSessions lists the caller's active sessions (GET) or signs them out
+// everywhere (DELETE). DELETE ?keepCurrent=true spares the calling session.
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleListSessions(w, r)
+	case http.MethodDelete:
+		handleRevokeAllSessions(w, r)
+	default:
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	claims := requestClaims(r)
+	// A session is active while its family still holds a usable refresh
+	// token.
+	rows, err := db.QueryContext(r.Context(), `SELECT s.id, s.user_agent, s.client_ip, s.created_at, s.last_seen_at
+		FROM sessions s
+		WHERE s.user_id = $1 AND s.revoked_at IS NULL AND EXISTS (
+			SELECT 1 FROM refresh_tokens rt
+			WHERE rt.family_id = s.id AND rt.used_at IS NULL AND rt.revoked_at IS NULL AND rt.expires_at > NOW())
+		ORDER BY s.last_seen_at DESC`, claims.UserID)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := make([]SessionResponse, 0)
+	for rows.Next() {
+		var s SessionResponse
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+			return
+		}
+		s.Current = s.ID == claims.SessionID
+		sessions = append(sessions, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func handleRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	claims := requestClaims(r)
+	keep := ""
+	if r.URL.Query().Get("keepCurrent") == "true" {
+		keep = claims.SessionID
+	}
+
+	revoked, err := revocations.RevokeSessions(claims.UserID, keep)
+	if err != nil {
+		sendError(w, err.Error(), "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+	if revoked > 0 {
+		recordAuthEvent(claims.Username, clientIP(r), EventSessionRevoked)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := requestClaims(r)
+	found, err := revocations.RevokeSession(claims.UserID, mux.Vars(r)["id"])
+	if err != nil {
+		sendError(w, err.Error(), "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		sendError(w, "", "Session not found", http.StatusNotFound)
+		return
+	}
+	recordAuthEvent(claims.Username, clientIP(r), EventSessionRevoked)
+
+	w.WriteHeader(http.StatusNoContent)
+}
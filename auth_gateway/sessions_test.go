@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRevokeSessions(t *testing.T) {
+	// The user is signed in on a laptop (the caller) and a phone.
+	caller := &TokenClaims{UserID: 2, Username: "bob", Role: RolePatron, SessionID: "laptop"}
+	sessionRevoked := func(id string) bool {
+		return revocations.IsRevoked(&TokenClaims{Username: "bob", SessionID: id})
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		vars       map[string]string
+		ended      []driver.Value // what the UPDATE ... RETURNING id reports
+		want       int
+		wantLaptop bool
+		wantPhone  bool
+	}{
+		{"sign out elsewhere", "DELETE", "/auth/sessions?keepCurrent=true", nil, []driver.Value{"phone"}, http.StatusNoContent, false, true},
+		{"sign out everywhere", "DELETE", "/auth/sessions", nil, []driver.Value{"laptop"}, http.StatusNoContent, true, false},
+		{"end one session", "DELETE", "/auth/sessions/phone", map[string]string{"id": "phone"}, nil, http.StatusNoContent, false, true},
+		{"wrong method", "PUT", "/auth/sessions", nil, nil, http.StatusMethodNotAllowed, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDB{rows: []fakeRow{{"RETURNING id", tt.ended}}}
+			openFakeDB(t, fake)
+			revocations = newRevocationStore(db)
+
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			req = req.WithContext(context.WithValue(req.Context(), claimsContextKey, caller))
+			handler := handleSessions
+			if tt.vars != nil {
+				req = mux.SetURLVars(req, tt.vars)
+				handler = handleRevokeSession
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("%s %s = %d, want %d: %s", tt.method, tt.target, rec.Code, tt.want, rec.Body)
+			}
+			if got := sessionRevoked("laptop"); got != tt.wantLaptop {
+				t.Errorf("laptop revoked = %v, want %v", got, tt.wantLaptop)
+			}
+			if got := sessionRevoked("phone"); got != tt.wantPhone {
+				t.Errorf("phone revoked = %v, want %v", got, tt.wantPhone)
+			}
+			// Ending a session also ends its refresh token family.
+			ended := tt.wantLaptop || tt.wantPhone
+			if got := fake.ran("UPDATE refresh_tokens SET revoked_at"); got != ended {
+				t.Errorf("refresh family revoked = %v, want %v", got, ended)
+			}
+		})
+	}
+}
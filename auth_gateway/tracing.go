@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/uptrace/opentelemetry-go-extra/otelsql"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	serviceName = "auth_gateway"
+	// soapTraceNamespace qualifies the trace context in SOAP headers.
+	soapTraceNamespace = "http://example.com/trace"
+)
+
+// dbTracerProvider only records database spans that belong to a traced
+// request, so background work such as the revocation sync does not start a
+// trace for every query.
+var dbTracerProvider trace.TracerProvider = noop.NewTracerProvider()
+
+// setupTracing installs the tracer provider and the W3C trace context
+// propagator. OTEL_TRACES_EXPORTER chooses where spans go: otlp (to
+// OTEL_EXPORTER_OTLP_ENDPOINT, default http://localhost:4318), stdout, or
+// none (default). The gateway starts traces even when nothing is exported,
+// so services still receive a trace context to continue. shutdown flushes
+// the spans still waiting to be exported; call it before exiting.
+func setupTracing() (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	switch name := getEnv("OTEL_TRACES_EXPORTER", "none"); name {
+	case "none":
+		provider := sdktrace.NewTracerProvider()
+		otel.SetTracerProvider(provider)
+		return provider.Shutdown, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	case "stdout", "console":
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults.
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	spans := sdktrace.NewBatchSpanProcessor(exporter)
+	provider := sdktrace.NewTracerProvider(sdktrace.WithResource(res), sdktrace.WithSpanProcessor(spans))
+	dbProvider := sdktrace.NewTracerProvider(sdktrace.WithResource(res), sdktrace.WithSpanProcessor(spans),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.NeverSample())))
+	otel.SetTracerProvider(provider)
+	dbTracerProvider = dbProvider
+	return func(ctx context.Context) error {
+		return errors.Join(provider.Shutdown(ctx), dbProvider.Shutdown(ctx))
+	}, nil
+}
+
+// openDB opens the database with a span for every query. Queries only join
+// the caller's trace when they are given the request context.
+func openDB(connStr, dbName string) (*sql.DB, error) {
+	return otelsql.Open("postgres", connStr,
+		otelsql.WithTracerProvider(dbTracerProvider),
+		otelsql.WithDBSystem("postgresql"),
+		otelsql.WithDBName(dbName),
+	)
+}
+
+// tracingMiddleware starts a trace for every request, with spans named
+// after the route. The gateway faces the internet, so a traceparent sent by
+// a client is only linked to, not continued.
+func tracingMiddleware(router *mux.Router, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, serviceName,
+		otelhttp.WithPublicEndpointFn(func(*http.Request) bool { return true }),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + routeLabel(router, r)
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return !isProbePath(r.URL.Path)
+		}),
+	)
+}
+
+// tracingTransport gives every attempt to reach an upstream of the named
+// route a client span and sends the trace context along.
+func tracingTransport(route string, base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return route + " " + r.Method
+		}),
+	)
+}
+
+// soapTraceHeader fills the empty SOAP header of envelope with the trace
+// context of ctx, for SOAP intermediaries that do not pass HTTP headers on.
+// The loan service prefers the traceparent HTTP header when it has both.
+func soapTraceHeader(ctx context.Context, envelope string) string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if carrier["traceparent"] == "" {
+		return envelope
+	}
+
+	var header strings.Builder
+	header.WriteString(`<soapenv:Header><trace xmlns="` + soapTraceNamespace + `">`)
+	for _, field := range []string{"traceparent", "tracestate"} {
+		if value := carrier[field]; value != "" {
+			header.WriteString("<" + field + ">")
+			xml.EscapeText(&header, []byte(value))
+			header.WriteString("</" + field + ">")
+		}
+	}
+	header.WriteString("</trace></soapenv:Header>")
+	return strings.Replace(envelope, "<soapenv:Header/>", header.String(), 1)
+}
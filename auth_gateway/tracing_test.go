@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider that keeps every finished span.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestSOAPTraceHeader(t *testing.T) {
+	recordSpans(t)
+	envelope := `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/"><soapenv:Header/><soapenv:Body/></soapenv:Envelope>`
+
+	if got := soapTraceHeader(context.Background(), envelope); got != envelope {
+		t.Errorf("without a span the envelope changed: %s", got)
+	}
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "loans")
+	defer span.End()
+	var parsed struct {
+		Trace struct {
+			XMLName     xml.Name
+			Traceparent string `xml:"traceparent"`
+		} `xml:"Header>trace"`
+	}
+	if err := xml.Unmarshal([]byte(soapTraceHeader(ctx, envelope)), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	trace := parsed.Trace
+	sc := span.SpanContext()
+	want := "00-" + sc.TraceID().String() + "-" + sc.SpanID().String() + "-01"
+	if trace.XMLName.Space != soapTraceNamespace || trace.Traceparent != want {
+		t.Errorf("SOAP trace header = {%s}%s, want {%s}%s", trace.XMLName.Space, trace.Traceparent, soapTraceNamespace, want)
+	}
+}
+
+func TestTracingMiddlewareAndTransport(t *testing.T) {
+	recorder := recordSpans(t)
+
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+	}))
+	defer upstream.Close()
+	client := &http.Client{Transport: tracingTransport("books", http.DefaultTransport)}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/books/{id}", func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, upstream.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	})
+	router.HandleFunc("/healthz", handleHealthz)
+	handler := tracingMiddleware(router, router)
+
+	const clientTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/api/books/1", nil)
+	req.Header.Set("traceparent", "00-"+clientTrace+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want the client call and the request; probes are not traced", len(spans))
+	}
+	call, server := spans[0], spans[1]
+	if server.Name() != "GET /api/books/{id}" || call.Name() != "books GET" {
+		t.Errorf("span names = %q, %q", server.Name(), call.Name())
+	}
+	// A client's trace is linked, never continued.
+	if server.Parent().IsValid() || server.SpanContext().TraceID().String() == clientTrace {
+		t.Error("the gateway continued the client's trace")
+	}
+	if links := server.Links(); len(links) != 1 || links[0].SpanContext.TraceID().String() != clientTrace {
+		t.Errorf("links = %v, want the client's trace", links)
+	}
+	if call.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("the upstream call is not a child of the request span")
+	}
+	if !strings.Contains(upstreamTraceparent, call.SpanContext().SpanID().String()) {
+		t.Errorf("upstream traceparent = %q, want the call's span", upstreamTraceparent)
+	}
+}
+
+func TestSetupTracingExporters(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	shutdown, err := setupTracing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(t.Context()); err != nil {
+		t.Errorf("shutdown = %v", err)
+	}
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+	if _, err := setupTracing(); err == nil {
+		t.Error("setupTracing accepted an unknown exporter")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing strategies for a route's upstreams.
+const (
+	BalancerRoundRobin       = "round_robin"
+	BalancerLeastConnections = "least_connections"
+)
+
+// errNoHealthyUpstream is returned when every instance of a pool is out of
+// rotation. RetryAfter is when the first of them is expected back.
+type errNoHealthyUpstream struct {
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e *errNoHealthyUpstream) Error() string {
+	return fmt.Sprintf("no healthy upstream for %s", e.Name)
+}
+
+// healthCheckSpec configures active health checks. Checks only run when Path
+// is set; an instance is healthy while GET Path answers with a 2xx status.
+type healthCheckSpec struct {
+	Path               string        `yaml:"path"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	HealthyThreshold   int           `yaml:"healthy_threshold"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+}
+
+// ejectionSpec configures passive ejection: after ConsecutiveErrors failed
+// requests in a row an instance is skipped for Duration.
+type ejectionSpec struct {
+	ConsecutiveErrors int           `yaml:"consecutive_errors"`
+	Duration          time.Duration `yaml:"duration"`
+}
+
+// upstreamTarget is one instance of a service.
+type upstreamTarget struct {
+	URL    *url.URL
+	active atomic.Int64 // requests in flight
+
+	mu           sync.Mutex
+	healthy      bool // verdict of the active health checks
+	passes       int  // consecutive passed checks while unhealthy
+	fails        int  // consecutive failed checks while healthy
+	errors       int  // consecutive failed requests
+	ejectedUntil time.Time
+}
+
+func (t *upstreamTarget) available(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.healthy && !now.Before(t.ejectedUntil)
+}
+
+// upstreamPool balances a route's requests over its upstream instances and
+// keeps unhealthy ones out of rotation.
+type upstreamPool struct {
+	name     string
+	targets  []*upstreamTarget
+	balancer string
+	check    healthCheckSpec
+	ejection ejectionSpec
+
+	next atomic.Uint64
+	stop chan struct{}
+}
+
+func newUpstreamPool(name string, urls []string, balancer string, check healthCheckSpec, ejection ejectionSpec) (*upstreamPool, error) {
+	p := &upstreamPool{name: name, balancer: balancer, check: check, ejection: ejection, stop: make(chan struct{})}
+
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("at least one upstream is required")
+	}
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q", raw)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		p.targets = append(p.targets, &upstreamTarget{URL: u, healthy: true})
+	}
+
+	switch p.balancer {
+	case "":
+		p.balancer = BalancerRoundRobin
+	case BalancerRoundRobin, BalancerLeastConnections:
+	default:
+		return nil, fmt.Errorf("unknown balancer %q", balancer)
+	}
+
+	if p.check.Path != "" {
+		if !strings.HasPrefix(p.check.Path, "/") {
+			return nil, fmt.Errorf("health check path must start with /")
+		}
+		if p.check.Interval <= 0 {
+			p.check.Interval = 10 * time.Second
+		}
+		if p.check.Timeout <= 0 {
+			p.check.Timeout = 2 * time.Second
+		}
+		if p.check.HealthyThreshold <= 0 {
+			p.check.HealthyThreshold = 2
+		}
+		if p.check.UnhealthyThreshold <= 0 {
+			p.check.UnhealthyThreshold = 3
+		}
+	}
+
+	if p.ejection.ConsecutiveErrors <= 0 {
+		p.ejection.ConsecutiveErrors = 5
+	}
+	if p.ejection.Duration <= 0 {
+		p.ejection.Duration = 30 * time.Second
+	}
+	return p, nil
+}
+
+// acquire picks an available instance and counts the request against it.
+// Every successful acquire must be paired with a release.
+func (p *upstreamPool) acquire() (*upstreamTarget, error) {
+	now := time.Now()
+	start := p.next.Add(1) - 1
+	var picked *upstreamTarget
+	for i := range p.targets {
+		t := p.targets[(start+uint64(i))%uint64(len(p.targets))]
+		if !t.available(now) {
+			continue
+		}
+		if p.balancer == BalancerRoundRobin {
+			picked = t
+			break
+		}
+		// Least connections; the rotating start breaks ties evenly.
+		if picked == nil || t.active.Load() < picked.active.Load() {
+			picked = t
+		}
+	}
+	if picked == nil {
+		return nil, &errNoHealthyUpstream{Name: p.name, RetryAfter: p.retryAfter(now)}
+	}
+	picked.active.Add(1)
+	return picked, nil
+}
+
+// retryAfter estimates how long until an instance is back in rotation: the
+// earliest end of an ejection, or, for an instance failing its health
+// checks, the time it takes to pass enough of them.
+func (p *upstreamPool) retryAfter(now time.Time) time.Duration {
+	recovery := p.check.Interval * time.Duration(p.check.HealthyThreshold)
+	var soonest time.Duration
+	for i, t := range p.targets {
+		t.mu.Lock()
+		wait := max(t.ejectedUntil.Sub(now), 0)
+		if !t.healthy {
+			wait = max(wait, recovery)
+		}
+		t.mu.Unlock()
+		if i == 0 || wait < soonest {
+			soonest = wait
+		}
+	}
+	return soonest
+}
+
+// release ends a request started with acquire. A failed request is a
+// transport error or a 5xx answer; enough of them in a row eject the
+// instance for a while.
+func (p *upstreamPool) release(t *upstreamTarget, failed bool) {
+	t.active.Add(-1)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !failed {
+		t.errors = 0
+		return
+	}
+	t.errors++
+	if t.errors >= p.ejection.ConsecutiveErrors {
+		t.errors = 0
+		t.ejectedUntil = time.Now().Add(p.ejection.Duration)
+		log.Printf("Ejected upstream %s of %s for %s after %d consecutive errors",
+			t.URL, p.name, p.ejection.Duration, p.ejection.ConsecutiveErrors)
+	}
+}
+
+// runHealthChecks probes every instance each interval until the pool is
+// closed.
+func (p *upstreamPool) runHealthChecks() {
+	if p.check.Path == "" {
+		return
+	}
+	client := &http.Client{Timeout: p.check.Timeout}
+	ticker := time.NewTicker(p.check.Interval)
+	defer ticker.Stop()
+	for {
+		for _, t := range p.targets {
+			p.recordCheck(t, probeUpstream(client, t.URL.String()+p.check.Path))
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func probeUpstream(client *http.Client, target string) bool {
+	resp, err := client.Get(target)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// recordCheck flips an instance's health once enough checks in a row agree.
+func (p *upstreamPool) recordCheck(t *upstreamTarget, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case ok && !t.healthy:
+		t.passes++
+		if t.passes >= p.check.HealthyThreshold {
+			t.healthy, t.passes = true, 0
+			log.Printf("Upstream %s of %s is healthy again", t.URL, p.name)
+		}
+	case !ok && t.healthy:
+		t.fails++
+		if t.fails >= p.check.UnhealthyThreshold {
+			t.healthy, t.fails = false, 0
+			log.Printf("Upstream %s of %s failed %d health checks, taking it out of rotation",
+				t.URL, p.name, p.check.UnhealthyThreshold)
+		}
+	default:
+		t.passes, t.fails = 0, 0
+	}
+}
+
+func (p *upstreamPool) status() []UpstreamStatus {
+	now := time.Now()
+	statuses := make([]UpstreamStatus, 0, len(p.targets))
+	for _, t := range p.targets {
+		t.mu.Lock()
+		s := UpstreamStatus{URL: t.URL.String(), Healthy: t.healthy, Active: t.active.Load()}
+		if now.Before(t.ejectedUntil) {
+			ejectedUntil := t.ejectedUntil
+			s.EjectedUntil = &ejectedUntil
+		}
+		t.mu.Unlock()
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+func (p *upstreamPool) close() {
+	close(p.stop)
+}
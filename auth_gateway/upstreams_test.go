@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNoHealthyUpstreamRetryAfter(t *testing.T) {
+	pool, err := newUpstreamPool("books", []string{"http://a", "http://b"}, "",
+		healthCheckSpec{Path: "/healthz", Interval: 10 * time.Second, HealthyThreshold: 2},
+		ejectionSpec{ConsecutiveErrors: 1, Duration: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One instance fails its health checks, the other is ejected; the
+	// unhealthy one needs two passing checks and is expected back first.
+	pool.targets[0].healthy = false
+	pool.targets[1].active.Add(1)
+	pool.release(pool.targets[1], true)
+
+	_, err = pool.acquire()
+	var unhealthy *errNoHealthyUpstream
+	if !errors.As(err, &unhealthy) {
+		t.Fatalf("acquire() error = %v, want errNoHealthyUpstream", err)
+	}
+	if unhealthy.RetryAfter != 20*time.Second {
+		t.Errorf("RetryAfter = %s, want 20s", unhealthy.RetryAfter)
+	}
+
+	pool.targets[0].healthy = true
+	pool.targets[0].ejectedUntil = time.Now().Add(5 * time.Second)
+	_, err = pool.acquire()
+	if !errors.As(err, &unhealthy) {
+		t.Fatalf("acquire() error = %v, want errNoHealthyUpstream", err)
+	}
+	if unhealthy.RetryAfter <= 4*time.Second || unhealthy.RetryAfter > 5*time.Second {
+		t.Errorf("RetryAfter = %s, want the 5s left of the ejection", unhealthy.RetryAfter)
+	}
+
+	rec := httptest.NewRecorder()
+	sendUpstreamError(rec, err, "Failed to reach book service")
+	if got := rec.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("Retry-After = %q, want 5", got)
+	}
+}
+
+func TestUpstreamBalancers(t *testing.T) {
+	acquireAll := func(p *upstreamPool, n int) map[string]int {
+		picked := map[string]int{}
+		for range n {
+			target, err := p.acquire()
+			if err != nil {
+				t.Fatal(err)
+			}
+			picked[target.URL.Host]++
+			p.release(target, false)
+		}
+		return picked
+	}
+
+	pool, err := newUpstreamPool("books", []string{"http://a", "http://b", "http://c"}, "", healthCheckSpec{}, ejectionSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := acquireAll(pool, 6); got["a"] != 2 || got["b"] != 2 || got["c"] != 2 {
+		t.Errorf("round robin spread = %v, want 2 each", got)
+	}
+	pool.targets[1].healthy = false
+	if got := acquireAll(pool, 6); got["b"] != 0 || got["a"] == 0 || got["c"] == 0 {
+		t.Errorf("round robin with b unhealthy = %v, want a and c only", got)
+	}
+
+	pool, err = newUpstreamPool("books", []string{"http://a", "http://b", "http://c"}, BalancerLeastConnections, healthCheckSpec{}, ejectionSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.targets[0].active.Store(2)
+	pool.targets[2].active.Store(1)
+	for range 3 {
+		target, err := pool.acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target.URL.Host != "b" {
+			t.Fatalf("least connections picked %s, want b", target.URL.Host)
+		}
+		pool.release(target, false)
+	}
+}
+
+func TestUpstreamHealthAndEjection(t *testing.T) {
+	pool, err := newUpstreamPool("books", []string{"http://a"}, "",
+		healthCheckSpec{Path: "/healthz", HealthyThreshold: 2, UnhealthyThreshold: 3},
+		ejectionSpec{ConsecutiveErrors: 2, Duration: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := pool.targets[0]
+
+	// Checks flip the verdict only after enough agree in a row.
+	steps := []struct {
+		ok          bool
+		wantHealthy bool
+	}{
+		{false, true},
+		{false, true},
+		{true, true}, // resets the count
+		{false, true},
+		{false, true},
+		{false, false},
+		{true, false},
+		{true, true},
+	}
+	for i, step := range steps {
+		pool.recordCheck(target, step.ok)
+		if target.healthy != step.wantHealthy {
+			t.Fatalf("check %d (ok=%v): healthy = %v, want %v", i+1, step.ok, target.healthy, step.wantHealthy)
+		}
+	}
+
+	// Failed requests eject the instance once enough come in a row.
+	for _, failed := range []bool{true, false, true} {
+		target.active.Add(1)
+		pool.release(target, failed)
+	}
+	if _, err := pool.acquire(); err != nil {
+		t.Fatalf("instance ejected after non-consecutive errors: %v", err)
+	}
+	pool.release(target, true)
+	if _, err := pool.acquire(); err == nil {
+		t.Fatal("instance still in rotation after two errors in a row")
+	}
+	if s := pool.status()[0]; s.EjectedUntil == nil || s.Active != 0 {
+		t.Errorf("status = %+v, want ejected with no active requests", s)
+	}
+}
+
+func TestNewUpstreamPoolRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		urls     []string
+		balancer string
+		check    healthCheckSpec
+	}{
+		{"no upstreams", nil, "", healthCheckSpec{}},
+		{"relative upstream", []string{"/books"}, "", healthCheckSpec{}},
+		{"unknown scheme", []string{"ftp://books"}, "", healthCheckSpec{}},
+		{"unknown balancer", []string{"http://books"}, "random", healthCheckSpec{}},
+		{"relative check path", []string{"http://books"}, "", healthCheckSpec{Path: "healthz"}},
+	}
+	for _, tt := range tests {
+		if _, err := newUpstreamPool("books", tt.urls, tt.balancer, tt.check, ejectionSpec{}); err == nil {
+			t.Errorf("%s: newUpstreamPool succeeded", tt.name)
+		}
+	}
+}
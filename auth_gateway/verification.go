@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Email verification modes. With "login" unverified accounts cannot log in at
+// all; with "borrow" they can log in and browse but not borrow books.
+const (
+	EmailVerificationOff    = "off"
+	EmailVerificationLogin  = "login"
+	EmailVerificationBorrow = "borrow"
+)
+
+const (
+	EventEmailVerificationSent = "email_verification_sent"
+	EventEmailVerified         = "email_verified"
+)
+
+var (
+	emailVerificationMode = EmailVerificationOff
+	emailVerificationTTL  = 24 * time.Hour
+	emailVerificationURL  = "http://localhost:8080/auth/verify"
+)
+
+func loadEmailVerificationConfig() error {
+	mode := getEnv("EMAIL_VERIFICATION", emailVerificationMode)
+	switch mode {
+	case EmailVerificationOff, EmailVerificationLogin, EmailVerificationBorrow:
+	default:
+		return fmt.Errorf("invalid EMAIL_VERIFICATION %q, expected off, login or borrow", mode)
+	}
+	emailVerificationMode = mode
+	emailVerificationTTL = getEnvDuration("EMAIL_VERIFICATION_TTL", emailVerificationTTL)
+	emailVerificationURL = getEnv("EMAIL_VERIFICATION_URL", emailVerificationURL)
+	return nil
+}
+
+// generateVerificationToken signs a link token for the user's current
+// address. Changing the address invalidates links sent to the old one.
+func generateVerificationToken(userID int64, username, email string) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return signJWT(jwt.MapClaims{
+		"typ":   TokenTypeEmailVerify,
+		"sub":   username,
+		"uid":   userID,
+		"email": email,
+		"jti":   jti,
+		"iat":   now.Unix(),
+		"exp":   now.Add(emailVerificationTTL).Unix(),
+	})
+}
+
+// sendVerificationEmail sends the link in the background and logs failures.
+// Waiting for the mail server would hold up registration and make
+// unverified accounts answer /auth/verify/resend measurably slower.
+func sendVerificationEmail(userID int64, username, email string) {
+	go func() {
+		if err := notifyVerification(userID, username, email); err != nil {
+			log.Printf("Failed to send verification email to %s: %v", username, err)
+		}
+	}()
+}
+
+func notifyVerification(userID int64, username, email string) error {
+	token, err := generateVerificationToken(userID, username, email)
+	if err != nil {
+		return err
+	}
+	body := fmt.Sprintf("Hello %s,\n\nPlease confirm your email address by opening the following link. It expires in %s.\n\n%s?token=%s\n\nIf you did not create a library account, you can ignore this message.",
+		username, emailVerificationTTL, emailVerificationURL, token)
+	if err := notifier.Notify(email, "Confirm your library account", body); err != nil {
+		return err
+	}
+	recordAuthEvent(username, "", EventEmailVerificationSent)
+	return nil
+}
+
+func isEmailVerified(userID int64) (bool, error) {
+	var verifiedAt sql.NullTime
+	err := db.QueryRow("SELECT email_verified_at FROM user_credentials WHERE user_id = $1", userID).Scan(&verifiedAt)
+	return verifiedAt.Valid, err
+}
+
+// requireVerifiedEmail writes a 403 and returns false if the user has not
+// verified their address yet and the configured mode is mode.
+func requireVerifiedEmail(w http.ResponseWriter, userID int64, mode string) bool {
+	if emailVerificationMode != mode {
+		return true
+	}
+	verified, err := isEmailVerified(userID)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if !verified {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(ErrorResponse{
+			Error:   "Email address not verified",
+			Message: "Open the link sent to your email address, or ask for a new one at /auth/verify/resend",
+		})
+		return false
+	}
+	return true
+}
+
+// handleVerifyEmail accepts the token from the link as a query parameter
+// (GET, when the link is opened) or in a JSON body (POST).
+func handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var token string
+	switch r.Method {
+	case http.MethodGet:
+		token = r.URL.Query().Get("token")
+	case http.MethodPost:
+		var req VerifyEmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendError(w, err.Error(), "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		token = req.Token
+	default:
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, err := validateTokenOfType(token, TokenTypeEmailVerify)
+	if err != nil || claims.UserID == 0 {
+		sendError(w, "", "Invalid or expired verification link", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `UPDATE user_credentials uc SET email_verified_at = COALESCE(uc.email_verified_at, NOW())
+		FROM users u WHERE u.id = uc.user_id AND uc.user_id = $1 AND LOWER(u.email) = LOWER($2)`,
+		claims.UserID, claims.Email)
+	if err != nil {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		sendError(w, "", "Invalid or expired verification link", http.StatusBadRequest)
+		return
+	}
+
+	recordAuthEvent(claims.Username, clientIP(r), EventEmailVerified)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MessageResponse{Message: "Email address verified"})
+}
+
+func handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, "", "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, err.Error(), "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Username == "" && req.Email == "" {
+		sendError(w, "", "Username or email is required", http.StatusBadRequest)
+		return
+	}
+
+	var userID int64
+	var username, email string
+	err := db.QueryRowContext(r.Context(), `SELECT uc.user_id, uc.username, u.email
+		FROM user_credentials uc JOIN users u ON u.id = uc.user_id
+		WHERE uc.email_verified_at IS NULL AND (($1 <> '' AND uc.username = $1) OR ($2 <> '' AND LOWER(u.email) = LOWER($2)))
+		LIMIT 1`, req.Username, strings.TrimSpace(req.Email)).Scan(&userID, &username, &email)
+	if err != nil && err != sql.ErrNoRows {
+		sendError(w, err.Error(), "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		sendVerificationEmail(userID, username, email)
+	}
+
+	// Same answer whether or not the account exists or is already verified.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(MessageResponse{Message: "If the account exists and is not verified yet, a new link has been sent"})
+}
@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	_ "github.com/lib/pq"
+	"identity"
 )
 
 type Book struct {
@@ -45,7 +50,12 @@ func main() {
 
 	connectionString := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", dbHost, dbPort, dbUser, dbPassword, dbName)
 
-	db, err = sql.Open("postgres", connectionString)
+	shutdownTracing, err := setupTracing()
+	if err != nil {
+		log.Fatalf("setupTracing error: %v", err)
+	}
+
+	db, err = openDB(connectionString, dbName)
 	if err != nil {
 		log.Fatalf("sql.Open error: %v", err)
 	}
@@ -65,6 +75,9 @@ func main() {
 
 	log.Println("Book Service connected to database")
 
+	identitySigningKey = []byte(getEnv("IDENTITY_SIGNING_KEY", ""))
+	registerMetrics(dbName)
+
 	router := mux.NewRouter()
 	router.HandleFunc("/api/books/search", searchBookByTitle).Methods("GET")
 	router.HandleFunc("/api/books", getAllBooks).Methods("GET")
@@ -72,6 +85,9 @@ func main() {
 	router.HandleFunc("/api/books", createBook).Methods("POST")
 	router.HandleFunc("/api/books/{id}", updateBook).Methods("PUT")
 	router.HandleFunc("/api/books/{id}", deleteBook).Methods("DELETE")
+	router.HandleFunc(healthzPath, handleHealthz).Methods("GET")
+	router.HandleFunc(readyzPath, handleReadyz).Methods("GET")
+	router.Handle(metricsPath, promhttp.Handler()).Methods("GET")
 
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
@@ -80,10 +96,38 @@ func main() {
         AllowCredentials: true,
 	})
 
-	handler := c.Handler(router)
+	handler := tracingMiddleware(router, metricsMiddleware(router, identityMiddleware(c.Handler(router))))
 
 	log.Println("Book Service running on port 8081")
-	log.Fatal(http.ListenAndServe(":8081", handler))
+	serve(&http.Server{Addr: ":8081", Handler: handler}, shutdownTracing)
+}
+
+// shutdownTimeout stays under the 10 seconds docker stop waits before it
+// kills the process.
+const shutdownTimeout = 8 * time.Second
+
+// serve runs server until SIGINT or SIGTERM, then lets the requests in
+// flight finish and flushes the spans not yet exported.
+func serve(server *http.Server, shutdownTracing func(context.Context) error) {
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("server shutdown error: %v", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("tracing shutdown error: %v", err)
+	}
 }
 
 func getEnv(key, defaultValue string) string {
@@ -98,7 +142,7 @@ func getAllBooks(w http.ResponseWriter, r *http.Request) {
 	page, limit := getPaginationParams(r)
 	offset := (page - 1) * limit
 
-	rows, err := db.Query(`
+	rows, err := db.QueryContext(r.Context(), `
 	SELECT id, isbn, title, author, publish_year, category, available_quantity 
 	FROM books
 	ORDER BY id
@@ -145,7 +189,7 @@ func getBookByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var b Book
-	err = db.QueryRow("SELECT id, isbn, title, author, publish_year, category, available_quantity FROM books WHERE id = $1", id).Scan(&b.ID, &b.ISBN, &b.Title, &b.Author, &b.PublishYear, &b.Category, &b.AvailableQuantity)
+	err = db.QueryRowContext(r.Context(), "SELECT id, isbn, title, author, publish_year, category, available_quantity FROM books WHERE id = $1", id).Scan(&b.ID, &b.ISBN, &b.Title, &b.Author, &b.PublishYear, &b.Category, &b.AvailableQuantity)
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "Book not found", http.StatusNotFound)
@@ -171,13 +215,13 @@ func searchBookByTitle(w http.ResponseWriter, r *http.Request) {
 
 	// Get total count
 	var total int
-	err := db.QueryRow("SELECT COUNT(*) FROM books WHERE title ILIKE $1", "%"+title+"%").Scan(&total)
+	err := db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM books WHERE title ILIKE $1", "%"+title+"%").Scan(&total)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	rows, err := db.Query(`
+	rows, err := db.QueryContext(r.Context(), `
 	SELECT id, isbn, title, author, publish_year, category, available_quantity
 	FROM books
 	WHERE title ILIKE $1
@@ -232,12 +276,13 @@ func createBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := db.QueryRow("INSERT INTO books (isbn, title, author, publish_year, category, available_quantity) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id", b.ISBN, b.Title, b.Author, b.PublishYear, b.Category, b.AvailableQuantity).Scan(&b.ID)
+	err := db.QueryRowContext(r.Context(), "INSERT INTO books (isbn, title, author, publish_year, category, available_quantity) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id", b.ISBN, b.Title, b.Author, b.PublishYear, b.Category, b.AvailableQuantity).Scan(&b.ID)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("Book %d created by %s (request %s)", b.ID, identity.Caller(r), identity.FromRequest(r).RequestID)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -259,12 +304,13 @@ func updateBook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// FIX: Use id from URL path, not b.ID from request body
-	_, err = db.Exec("UPDATE books SET isbn = $1, title = $2, author = $3, publish_year = $4, category = $5, available_quantity = $6 WHERE id = $7", b.ISBN, b.Title, b.Author, b.PublishYear, b.Category, b.AvailableQuantity, id)
+	_, err = db.ExecContext(r.Context(), "UPDATE books SET isbn = $1, title = $2, author = $3, publish_year = $4, category = $5, available_quantity = $6 WHERE id = $7", b.ISBN, b.Title, b.Author, b.PublishYear, b.Category, b.AvailableQuantity, id)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("Book %d updated by %s (request %s)", id, identity.Caller(r), identity.FromRequest(r).RequestID)
 
 	b.ID = id
 	w.Header().Set("Content-Type", "application/json")
@@ -279,11 +325,12 @@ func deleteBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = db.Exec("DELETE FROM books WHERE id = $1", id)
+	_, err = db.ExecContext(r.Context(), "DELETE FROM books WHERE id = $1", id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("Book %d deleted by %s (request %s)", id, identity.Caller(r), identity.FromRequest(r).RequestID)
 
 	w.WriteHeader(http.StatusNoContent)
 }
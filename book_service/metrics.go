@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsPath = "/metrics"
+
+// HTTP metrics by route template, so /api/books/1 and /api/books/2 are
+// counted together. Requests that match no route use "unmatched".
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+// registerMetrics adds the database pool stats and the stock gauge. It needs
+// db to be open.
+func registerMetrics(dbName string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, dbName))
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "books_out_of_stock",
+		Help: "Books with no copies available.",
+	}, func() float64 {
+		return countRows("SELECT COUNT(*) FROM books WHERE available_quantity = 0")
+	})
+}
+
+// countRows runs a COUNT query for a gauge when Prometheus scrapes. A failed
+// query reports NaN rather than a misleading zero.
+func countRows(query string) float64 {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	var n int64
+	if err := db.QueryRowContext(ctx, query).Scan(&n); err != nil {
+		log.Printf("Metrics query failed: %v", err)
+		return math.NaN()
+	}
+	return float64(n)
+}
+
+// metricsMiddleware records every request handled by next under the route
+// of router it matches.
+func metricsMiddleware(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := routeLabel(router, r)
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeLabel is the path template of the route of router that r matches, or
+// "unmatched".
+func routeLabel(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if router.Match(r, &match) && match.Route != nil {
+		if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unmatched"
+}
+
+// statusRecorder remembers the status code of an answer.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader skips informational 1xx codes, which may precede the real one.
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader && status >= 200 {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetricsMiddlewareLabels(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/books/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "0" {
+			http.Error(w, "Book not found", http.StatusNotFound)
+			return
+		}
+		// An informational answer first; the final status counts.
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Write([]byte("{}"))
+	}).Methods("GET")
+	handler := metricsMiddleware(router, router)
+
+	for _, path := range []string{"/api/books/1", "/api/books/2", "/api/books/0", "/no/such/page"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest("GET", metricsPath, nil))
+	exposition := rec.Body.String()
+	for _, want := range []string{
+		`http_requests_total{method="GET",route="/api/books/{id}",status="200"} 2`,
+		`http_requests_total{method="GET",route="/api/books/{id}",status="404"} 1`,
+		`http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="/api/books/{id}"} 3`,
+	} {
+		if !strings.Contains(exposition, want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
+
+func TestCountRowsReportsFailedQueries(t *testing.T) {
+	db = sql.OpenDB(pingConnector{errors.New("connection refused")})
+	t.Cleanup(func() { db.Close(); db = nil })
+
+	if n := countRows("SELECT COUNT(*) FROM books WHERE available_quantity = 0"); !math.IsNaN(n) {
+		t.Errorf("countRows = %v, want NaN", n)
+	}
+}
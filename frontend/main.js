@@ -1,7 +1,10 @@
 // Global state
 const state = {
     token: localStorage.getItem('authToken') || '',
+    refreshToken: localStorage.getItem('refreshToken') || '',
     username: localStorage.getItem('username') || '',
+    userId: null,
+    role: '',
     baseUrl: 'http://localhost:8080'
 };
 
@@ -26,6 +29,7 @@ document.addEventListener('DOMContentLoaded', function () {
     // If we have a token, validate it on load
     if (state.token) {
         validateToken(state.token);
+        loadProfile();
     }
 });
 
@@ -57,7 +61,9 @@ function initAuth() {
 function updateAuthStatus() {
     if (state.token && state.username) {
         authStatus.classList.add('active');
-        authStatusText.textContent = `Authenticated as ${state.username}`;
+        authStatusText.textContent = state.role
+            ? `Authenticated as ${state.username} (${state.role})`
+            : `Authenticated as ${state.username}`;
         userInfo.classList.remove('hidden');
         userDetails.innerHTML = `
                     <div>
@@ -138,7 +144,7 @@ function updateApiParams() {
             paramsHTML = `
                         <div class="form-group">
                             <label for="loanUserId">User ID *</label>
-                            <input type="number" id="loanUserId" placeholder="Enter user ID" required>
+                            <input type="number" id="loanUserId" placeholder="Enter user ID" value="${state.userId || ''}" required>
                         </div>
                         <div class="form-group">
                             <label for="loanBookId">Book ID *</label>
@@ -160,7 +166,7 @@ function updateApiParams() {
             paramsHTML = `
                         <div class="form-group">
                             <label for="userLoansId">User ID *</label>
-                            <input type="number" id="userLoansId" placeholder="Enter user ID" required>
+                            <input type="number" id="userLoansId" placeholder="Enter user ID" value="${state.userId || ''}" required>
                         </div>
                     `;
             break;
@@ -222,9 +228,12 @@ async function makeRequest(url, method = 'GET', body = null, requiresAuth = fals
 
     try {
         const response = await fetch(`${state.baseUrl}${url}`, options);
-        const data = await response.json();
+        const data = response.status === 204 ? {} : await response.json();
 
         if (!response.ok) {
+            if (data.fields) {
+                throw new Error(data.fields.map(f => `${f.field}: ${f.message}`).join('; '));
+            }
             throw new Error(data.message || `HTTP ${response.status}`);
         }
 
@@ -252,16 +261,19 @@ async function login() {
 
     if (result.success) {
         state.token = result.data.token;
+        state.refreshToken = result.data.refreshToken;
         state.username = result.data.username;
 
         // Save to localStorage
         localStorage.setItem('authToken', state.token);
+        localStorage.setItem('refreshToken', state.refreshToken);
         localStorage.setItem('username', state.username);
 
         // Update UI
         tokenValue.textContent = state.token;
         loginToken.classList.remove('hidden');
         updateAuthStatus();
+        loadProfile();
 
         showNotification('Login successful! Token saved.', 'success');
 
@@ -296,7 +308,8 @@ async function register() {
     const result = await makeRequest('/auth/register', 'POST', userData);
 
     if (result.success) {
-        showNotification(`User ${username} registered successfully!`, 'success');
+        const verifyHint = result.data.emailVerified ? '' : ' Check your inbox to verify your email address.';
+        showNotification(`User ${username} registered successfully!${verifyHint}`, 'success');
 
         // Clear form
         document.getElementById('registerUsername').value = '';
@@ -330,11 +343,29 @@ async function validateToken(token) {
     }
 }
 
-function logout() {
+// Fetch the caller's id and role once instead of looking them up per request.
+async function loadProfile() {
+    const result = await makeRequest('/auth/me', 'GET', null, true);
+    if (result.success) {
+        state.userId = result.data.userId;
+        state.role = result.data.role;
+        updateAuthStatus();
+    }
+}
+
+async function logout() {
+    if (state.refreshToken) {
+        await makeRequest('/auth/logout', 'POST', { refreshToken: state.refreshToken }, true);
+    }
+
     state.token = '';
+    state.refreshToken = '';
     state.username = '';
+    state.userId = null;
+    state.role = '';
 
     localStorage.removeItem('authToken');
+    localStorage.removeItem('refreshToken');
     localStorage.removeItem('username');
 
     updateAuthStatus();
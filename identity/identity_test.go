@@ -0,0 +1,115 @@
+package identity
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignedIdentityVerifies(t *testing.T) {
+	key := []byte("shared-key")
+	signed := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "http://book_service/books?author=1", nil)
+		r.Header.Set(HeaderRequestID, "req-1")
+		r.Header.Set(HeaderUserID, "2")
+		r.Header.Set(HeaderUserName, "bob")
+		r.Header.Set(HeaderUserRoles, "patron")
+		Sign(r, key)
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(r *http.Request)
+		key    []byte
+		want   bool // verified, otherwise rejected
+	}{
+		{"as signed", func(*http.Request) {}, key, true},
+		{"other key", func(*http.Request) {}, []byte("other-key"), false},
+		{"other method", func(r *http.Request) { r.Method = http.MethodDelete }, key, false},
+		{"other path", func(r *http.Request) { r.URL.Path = "/books/1" }, key, false},
+		{"other query", func(r *http.Request) { r.URL.RawQuery = "author=2" }, key, false},
+		{"other request ID", func(r *http.Request) { r.Header.Set(HeaderRequestID, "req-2") }, key, false},
+		{"other role", func(r *http.Request) { r.Header.Set(HeaderUserRoles, "admin") }, key, false},
+		{"other user", func(r *http.Request) { r.Header.Set(HeaderUserID, "3") }, key, false},
+		{"no signature", func(r *http.Request) { r.Header.Del(HeaderIdentitySignature) }, key, false},
+		{"stale", func(r *http.Request) {
+			stale := strconv.FormatInt(time.Now().Add(-MaxAge-time.Minute).Unix(), 10)
+			r.Header.Set(HeaderIdentityTimestamp, stale)
+			r.Header.Set(HeaderIdentitySignature, Signature(key, stale, r.Method, r.URL.Path, r.URL.RawQuery, "req-1", "2", "bob", "patron"))
+		}, key, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := signed()
+			tt.tamper(r)
+			id, err := Read(r, tt.key)
+			if tt.want && (err != nil || !id.Verified) {
+				t.Fatalf("Read() = %+v, %v; want verified", id, err)
+			}
+			if !tt.want && err == nil {
+				t.Fatalf("Read() = %+v; want an error", id)
+			}
+			if id.RequestID != r.Header.Get(HeaderRequestID) {
+				t.Errorf("request ID = %q, want %q", id.RequestID, r.Header.Get(HeaderRequestID))
+			}
+		})
+	}
+
+	// A service without a key takes the caller as given, unverified.
+	id, err := Read(signed(), nil)
+	if err != nil || id.Verified || id.Username != "bob" || id.UserID != "2" || len(id.Roles) != 1 || id.Roles[0] != "patron" {
+		t.Errorf("Read() without key = %+v, %v", id, err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	key := []byte("shared-key")
+	var caller string
+	handler := Middleware(key, func(r *http.Request) bool { return r.URL.Path == "/healthz" },
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			caller = Caller(r)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+	tests := []struct {
+		name       string
+		path       string
+		user       string
+		forge      bool
+		want       int
+		wantCaller string
+	}{
+		{"signed caller", "/books", "bob", false, http.StatusNoContent, "bob"},
+		{"anonymous", "/books", "", false, http.StatusNoContent, "anonymous"},
+		{"forged caller", "/books", "bob", true, http.StatusUnauthorized, ""},
+		{"probe", "/healthz", "bob", true, http.StatusNoContent, "anonymous"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller = ""
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.Header.Set(HeaderRequestID, "req-1")
+			if tt.user != "" {
+				r.Header.Set(HeaderUserName, tt.user)
+				Sign(r, key)
+			}
+			if tt.forge {
+				r.Header.Set(HeaderUserRoles, "admin")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.path != "/healthz" && rec.Header().Get(HeaderRequestID) != "req-1" {
+				t.Errorf("answer request ID = %q, want req-1", rec.Header().Get(HeaderRequestID))
+			}
+			if caller != tt.wantCaller {
+				t.Errorf("caller = %q, want %q", caller, tt.wantCaller)
+			}
+		})
+	}
+}
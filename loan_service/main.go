@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"encoding/xml"
@@ -10,10 +11,14 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"syscall"
 	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"identity"
 )
 
 // Loan model matching the documentation
@@ -49,6 +54,10 @@ type LoansResult struct {
 
 var db *sql.DB
 
+// soapOperationTimeout bounds a SOAP operation, including its calls to the
+// book service, once the caller is no longer waiting for it.
+const soapOperationTimeout = 30 * time.Second
+
 func main() {
 	var err error
 	
@@ -62,7 +71,12 @@ func main() {
 	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		dbHost, dbPort, dbUser, dbPassword, dbName)
 
-	db, err = sql.Open("postgres", connStr)
+	shutdownTracing, err := setupTracing()
+	if err != nil {
+		log.Fatal("Failed to set up tracing:", err)
+	}
+
+	db, err = openDB(connStr, dbName)
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
@@ -84,9 +98,15 @@ func main() {
 
 	log.Println("Connected to database successfully")
 
+	identitySigningKey = []byte(getEnv("IDENTITY_SIGNING_KEY", ""))
+	registerMetrics(dbName)
+
 	// Setup routes - handle both /ws and /loan for compatibility
 	http.HandleFunc("/ws", handleLoan)
 	http.HandleFunc("/loan", handleLoan)
+	http.HandleFunc(healthzPath, handleHealthz)
+	http.HandleFunc(readyzPath, handleReadyz)
+	http.Handle(metricsPath, promhttp.Handler())
 
 	port := "8083"
 	log.Printf("Loan Service listening on port %s\n", port)
@@ -94,8 +114,35 @@ func main() {
 	log.Printf("  http://localhost:%s/ws", port)
 	log.Printf("  http://localhost:%s/loan", port)
 	
-	if err := http.ListenAndServe(":"+port, corsMiddleware(http.DefaultServeMux)); err != nil {
-		log.Fatal(err)
+	handler := tracingMiddleware(metricsMiddleware(identityMiddleware(corsMiddleware(http.DefaultServeMux))))
+	serve(&http.Server{Addr: ":" + port, Handler: handler}, shutdownTracing)
+}
+
+// shutdownTimeout stays under the 10 seconds docker stop waits before it
+// kills the process.
+const shutdownTimeout = 8 * time.Second
+
+// serve runs server until SIGINT or SIGTERM, then lets the requests in
+// flight finish and flushes the spans not yet exported.
+func serve(server *http.Server, shutdownTracing func(context.Context) error) {
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("server shutdown error: %v", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("tracing shutdown error: %v", err)
 	}
 }
 
@@ -214,33 +261,51 @@ func handleLoan(w http.ResponseWriter, r *http.Request) {
 	}
 
 	soapBody := string(body)
-	log.Printf("Received SOAP request: %s", soapBody[:min(200, len(soapBody))])
+	requestID := identity.FromRequest(r).RequestID
+	// Loans change both this database and the book service; finish an
+	// operation even if the caller goes away, but keep it in the trace and
+	// give up on a book service that hangs.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), soapOperationTimeout)
+	defer cancel()
+	log.Printf("Received SOAP request %s from %s: %s", requestID, identity.Caller(r), soapBody[:min(200, len(soapBody))])
 
 	var responseXML string
+	operation, failed := "unknown", false
+	start := time.Now()
 
 	if contains(soapBody, "createLoan") {
+		operation = "createLoan"
 		userID := extractValue(soapBody, "userId")
 		bookID := extractValue(soapBody, "bookId")
-		result := createLoan(userID, bookID)
+		result := createLoan(ctx, requestID, userID, bookID)
+		failed = result.Error != ""
 		responseXML = buildCreateLoanResponse(result)
 	} else if contains(soapBody, "returnLoan") {
+		operation = "returnLoan"
 		loanID := extractValue(soapBody, "loanId")
-		result := returnLoan(loanID)
+		result := returnLoan(ctx, requestID, loanID)
+		failed = result.Error != ""
 		responseXML = buildReturnLoanResponse(result)
 	} else if contains(soapBody, "getLoansByUser") {
+		operation = "getLoansByUser"
 		userID := extractValue(soapBody, "userId")
-		result := getLoansByUser(userID)
+		result := getLoansByUser(ctx, userID)
 		responseXML = buildGetLoansByUserResponse(result)
 	} else if contains(soapBody, "getLoanById") {
+		operation = "getLoanById"
 		loanID := extractValue(soapBody, "loanId")
-		result := getLoanById(loanID)
+		result := getLoanById(ctx, loanID)
+		failed = result.Error != ""
 		responseXML = buildGetLoanByIdResponse(result)
 	} else if contains(soapBody, "getAllLoans") {
-		result := getAllLoans()
+		operation = "getAllLoans"
+		result := getAllLoans(ctx)
 		responseXML = buildGetAllLoansResponse(result)
 	} else {
+		failed = true
 		responseXML = buildErrorResponse("Unknown operation")
 	}
+	observeSOAPOperation(operation, start, failed)
 
 	log.Printf("Sending response: %s", responseXML[:min(200, len(responseXML))])
 	w.Write([]byte(responseXML))
@@ -268,14 +333,14 @@ func contains(s, substr string) bool {
 }
 
 // createLoan implements the SOAP operation as per documentation
-func createLoan(userID, bookID string) LoanResult {
+func createLoan(ctx context.Context, requestID, userID, bookID string) LoanResult {
 	// Validate inputs
 	if userID == "" || bookID == "" {
 		return LoanResult{Error: "User ID and Book ID are required"}
 	}
 
 	// Step 1: Check if book exists
-	book, err := fetchBook(bookID)
+	book, err := fetchBook(ctx, requestID, bookID)
 	if err != nil {
 		log.Printf("Error fetching book %s: %v", bookID, err)
 		return LoanResult{Error: "Book not found or book service unavailable"}
@@ -291,7 +356,7 @@ func createLoan(userID, bookID string) LoanResult {
 	dueDate := loanDate.AddDate(0, 0, 14) // Add 14 days as per documentation
 
 	var loan Loan
-	err = db.QueryRow(
+	err = db.QueryRowContext(ctx,
 		`INSERT INTO loans (user_id, book_id, loan_date, due_date, status) 
 		 VALUES ($1, $2, $3, $4, $5) RETURNING id, user_id, book_id, loan_date, due_date, return_date, status`,
 		userID, bookID, loanDate, dueDate, "ACTIVE",
@@ -304,19 +369,19 @@ func createLoan(userID, bookID string) LoanResult {
 
 	// Step 4: Decrease book's availableQuantity by 1
 	book.AvailableQuantity--
-	if err := updateBook(bookID, book); err != nil {
+	if err := updateBook(ctx, requestID, bookID, book); err != nil {
 		// If we fail to update the book, rollback the loan
-		db.Exec("DELETE FROM loans WHERE id = $1", loan.ID)
+		db.ExecContext(ctx, "DELETE FROM loans WHERE id = $1", loan.ID)
 		log.Printf("Error updating book quantity: %v", err)
 		return LoanResult{Error: "Failed to update book quantity"}
 	}
 
-	log.Printf("Created loan ID %d for user %s, book %s", loan.ID, userID, bookID)
+	log.Printf("Created loan ID %d for user %s, book %s (request %s)", loan.ID, userID, bookID, requestID)
 	return LoanResult{Loan: &loan}
 }
 
 // returnLoan implements the SOAP operation as per documentation
-func returnLoan(loanID string) LoanResult {
+func returnLoan(ctx context.Context, requestID, loanID string) LoanResult {
 	if loanID == "" {
 		return LoanResult{Error: "Loan ID is required"}
 	}
@@ -325,7 +390,7 @@ func returnLoan(loanID string) LoanResult {
 	var loan Loan
 	var returnDate sql.NullTime
 	
-	err := db.QueryRow("SELECT id, user_id, book_id, loan_date, due_date, return_date, status FROM loans WHERE id = $1", loanID).
+	err := db.QueryRowContext(ctx, "SELECT id, user_id, book_id, loan_date, due_date, return_date, status FROM loans WHERE id = $1", loanID).
 		Scan(&loan.ID, &loan.UserID, &loan.BookID, &loan.LoanDate, &loan.DueDate, &returnDate, &loan.Status)
 
 	if err == sql.ErrNoRows {
@@ -343,7 +408,7 @@ func returnLoan(loanID string) LoanResult {
 	// Step 2: Set returnDate to current date
 	// Step 3: Set status to RETURNED
 	returnTime := time.Now()
-	_, err = db.Exec(
+	_, err = db.ExecContext(ctx,
 		"UPDATE loans SET return_date = $1, status = $2 WHERE id = $3",
 		returnTime, "RETURNED", loanID,
 	)
@@ -353,14 +418,14 @@ func returnLoan(loanID string) LoanResult {
 	}
 
 	// Step 4: Increase book's availableQuantity by 1
-	book, err := fetchBook(fmt.Sprintf("%d", loan.BookID))
+	book, err := fetchBook(ctx, requestID, fmt.Sprintf("%d", loan.BookID))
 	if err != nil {
 		log.Printf("Error fetching book for return: %v", err)
 		return LoanResult{Error: "Book service error during return"}
 	}
 
 	book.AvailableQuantity++
-	if err := updateBook(fmt.Sprintf("%d", loan.BookID), book); err != nil {
+	if err := updateBook(ctx, requestID, fmt.Sprintf("%d", loan.BookID), book); err != nil {
 		log.Printf("Error updating book quantity on return: %v", err)
 		return LoanResult{Error: "Failed to update book quantity on return"}
 	}
@@ -368,16 +433,16 @@ func returnLoan(loanID string) LoanResult {
 	loan.Status = "RETURNED"
 	loan.ReturnDate = &returnTime
 
-	log.Printf("Returned loan ID %s", loanID)
+	log.Printf("Returned loan ID %s (request %s)", loanID, requestID)
 	return LoanResult{Loan: &loan}
 }
 
-func getLoansByUser(userID string) LoansResult {
+func getLoansByUser(ctx context.Context, userID string) LoansResult {
 	if userID == "" {
 		return LoansResult{Loans: []Loan{}}
 	}
 
-	rows, err := db.Query("SELECT id, user_id, book_id, loan_date, due_date, return_date, status FROM loans WHERE user_id = $1 ORDER BY loan_date DESC", userID)
+	rows, err := db.QueryContext(ctx, "SELECT id, user_id, book_id, loan_date, due_date, return_date, status FROM loans WHERE user_id = $1 ORDER BY loan_date DESC", userID)
 	if err != nil {
 		log.Printf("Error querying loans for user %s: %v", userID, err)
 		return LoansResult{Loans: []Loan{}}
@@ -401,7 +466,7 @@ func getLoansByUser(userID string) LoansResult {
 	return LoansResult{Loans: loans}
 }
 
-func getLoanById(loanID string) LoanResult {
+func getLoanById(ctx context.Context, loanID string) LoanResult {
 	if loanID == "" {
 		return LoanResult{Error: "Loan ID is required"}
 	}
@@ -409,7 +474,7 @@ func getLoanById(loanID string) LoanResult {
 	var loan Loan
 	var returnDate sql.NullTime
 	
-	err := db.QueryRow("SELECT id, user_id, book_id, loan_date, due_date, return_date, status FROM loans WHERE id = $1", loanID).
+	err := db.QueryRowContext(ctx, "SELECT id, user_id, book_id, loan_date, due_date, return_date, status FROM loans WHERE id = $1", loanID).
 		Scan(&loan.ID, &loan.UserID, &loan.BookID, &loan.LoanDate, &loan.DueDate, &returnDate, &loan.Status)
 
 	if err == sql.ErrNoRows {
@@ -427,8 +492,8 @@ func getLoanById(loanID string) LoanResult {
 	return LoanResult{Loan: &loan}
 }
 
-func getAllLoans() LoansResult {
-	rows, err := db.Query("SELECT id, user_id, book_id, loan_date, due_date, return_date, status FROM loans ORDER BY loan_date DESC")
+func getAllLoans(ctx context.Context) LoansResult {
+	rows, err := db.QueryContext(ctx, "SELECT id, user_id, book_id, loan_date, due_date, return_date, status FROM loans ORDER BY loan_date DESC")
 	if err != nil {
 		log.Printf("Error querying all loans: %v", err)
 		return LoansResult{Loans: []Loan{}}
@@ -452,7 +517,10 @@ func getAllLoans() LoansResult {
 	return LoansResult{Loans: loans}
 }
 
-func fetchBook(bookID string) (*Book, error) {
+// fetchBook and updateBook pass the request ID on to the book service so
+// its log lines can be matched with ours, and the trace context so its spans
+// join the loan's trace.
+func fetchBook(ctx context.Context, requestID, bookID string) (*Book, error) {
 	// Try localhost first for testing, then the service name
 	urls := []string{
 		fmt.Sprintf("http://localhost:8081/api/books/%s", bookID),
@@ -461,7 +529,15 @@ func fetchBook(bookID string) (*Book, error) {
 
 	var lastErr error
 	for _, url := range urls {
-		resp, err := http.Get(url)
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		req.Header.Set(identity.HeaderRequestID, requestID)
+
+		client := &http.Client{Timeout: 5 * time.Second, Transport: bookServiceTransport}
+		resp, err := client.Do(req)
 		if err != nil {
 			lastErr = err
 			continue
@@ -482,7 +558,7 @@ func fetchBook(bookID string) (*Book, error) {
 	return nil, fmt.Errorf("failed to fetch book: %v", lastErr)
 }
 
-func updateBook(bookID string, book *Book) error {
+func updateBook(ctx context.Context, requestID, bookID string, book *Book) error {
 	bookJSON, err := json.Marshal(book)
 	if err != nil {
 		return err
@@ -496,14 +572,15 @@ func updateBook(bookID string, book *Book) error {
 
 	var lastErr error
 	for _, url := range urls {
-		req, err := http.NewRequest("PUT", url, bytes.NewBuffer(bookJSON))
+		req, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewBuffer(bookJSON))
 		if err != nil {
 			lastErr = err
 			continue
 		}
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(identity.HeaderRequestID, requestID)
 
-		client := &http.Client{Timeout: 5 * time.Second}
+		client := &http.Client{Timeout: 5 * time.Second, Transport: bookServiceTransport}
 		resp, err := client.Do(req)
 		if err != nil {
 			lastErr = err
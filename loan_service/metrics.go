@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsPath = "/metrics"
+
+// HTTP metrics by endpoint. Requests to any other path use "unmatched".
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	soapOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "soap_operations_total",
+		Help: "SOAP operations by operation and result (ok or error).",
+	}, []string{"operation", "result"})
+	soapOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "soap_operation_duration_seconds",
+		Help:    "SOAP operation latency, including calls to the book service.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+)
+
+var knownRoutes = map[string]bool{"/ws": true, "/loan": true, healthzPath: true, readyzPath: true, metricsPath: true}
+
+// registerMetrics adds the database pool stats and the loan gauges. It needs
+// db to be open.
+func registerMetrics(dbName string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, dbName))
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "loans_active",
+		Help: "Loans that have not been returned.",
+	}, func() float64 {
+		return countRows("SELECT COUNT(*) FROM loans WHERE status = 'ACTIVE'")
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "loans_overdue",
+		Help: "Loans that have not been returned and are past their due date.",
+	}, func() float64 {
+		return countRows("SELECT COUNT(*) FROM loans WHERE status = 'ACTIVE' AND due_date < CURRENT_DATE")
+	})
+}
+
+// observeSOAPOperation records one SOAP call handled by handleLoan.
+func observeSOAPOperation(operation string, start time.Time, failed bool) {
+	result := "ok"
+	if failed {
+		result = "error"
+	}
+	soapOperations.WithLabelValues(operation, result).Inc()
+	soapOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// countRows runs a COUNT query for a gauge when Prometheus scrapes. A failed
+// query reports NaN rather than a misleading zero.
+func countRows(query string) float64 {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	var n int64
+	if err := db.QueryRowContext(ctx, query).Scan(&n); err != nil {
+		log.Printf("Metrics query failed: %v", err)
+		return math.NaN()
+	}
+	return float64(n)
+}
+
+// metricsMiddleware records every request handled by next.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := routeLabel(r)
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(rec.status)).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeLabel is the path of r if it is one of the service's endpoints, or
+// "unmatched".
+func routeLabel(r *http.Request) string {
+	if knownRoutes[r.URL.Path] {
+		return r.URL.Path
+	}
+	return "unmatched"
+}
+
+// statusRecorder remembers the status code of an answer.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader skips informational 1xx codes, which may precede the real one.
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader && status >= 200 {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
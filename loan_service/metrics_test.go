@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetricsMiddlewareLabels(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", handleLoan)
+	mux.HandleFunc("/loan", handleLoan)
+	handler := metricsMiddleware(mux)
+
+	unknown := `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/"><soapenv:Body><renewLoan/></soapenv:Body></soapenv:Envelope>`
+	for _, req := range []struct{ method, path, body string }{
+		{"GET", "/ws", ""},
+		{"POST", "/ws", unknown},
+		{"POST", "/loan", unknown},
+		{"GET", "/ws/extra", ""},
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.path, strings.NewReader(req.body)))
+	}
+
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest("GET", metricsPath, nil))
+	exposition := rec.Body.String()
+	for _, want := range []string{
+		`http_requests_total{method="GET",route="/ws",status="200"} 1`,
+		`http_requests_total{method="POST",route="/ws",status="200"} 1`,
+		`http_requests_total{method="POST",route="/loan",status="200"} 1`,
+		// Arbitrary paths share one label rather than growing the series.
+		`http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`soap_operations_total{operation="unknown",result="error"} 2`,
+		`soap_operation_duration_seconds_count{operation="unknown"} 2`,
+	} {
+		if !strings.Contains(exposition, want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/uptrace/opentelemetry-go-extra/otelsql"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const serviceName = "loan_service"
+
+// dbTracerProvider only records database spans that belong to a traced
+// request, so queries run in the background, such as those behind the
+// metrics gauges, do not each start a trace.
+var dbTracerProvider trace.TracerProvider = noop.NewTracerProvider()
+
+// bookServiceTransport adds a client span and the trace context to calls to
+// the book service.
+var bookServiceTransport = otelhttp.NewTransport(http.DefaultTransport,
+	otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return "book_service " + r.Method
+	}),
+)
+
+var soapHeaderPattern = regexp.MustCompile(`(?s)<(?:\w+:)?Header[\s>].*?</(?:\w+:)?Header>`)
+
+// setupTracing installs the tracer provider and the W3C trace context
+// propagator. OTEL_TRACES_EXPORTER chooses where spans go: otlp (to
+// OTEL_EXPORTER_OTLP_ENDPOINT, default http://localhost:4318), stdout, or
+// none (default). Trace context is passed on even when nothing is exported.
+// shutdown flushes the spans still waiting to be exported; call it before
+// exiting.
+func setupTracing() (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	switch name := getEnv("OTEL_TRACES_EXPORTER", "none"); name {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	case "stdout", "console":
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults.
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	spans := sdktrace.NewBatchSpanProcessor(exporter)
+	provider := sdktrace.NewTracerProvider(sdktrace.WithResource(res), sdktrace.WithSpanProcessor(spans))
+	dbProvider := sdktrace.NewTracerProvider(sdktrace.WithResource(res), sdktrace.WithSpanProcessor(spans),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.NeverSample())))
+	otel.SetTracerProvider(provider)
+	dbTracerProvider = dbProvider
+	return func(ctx context.Context) error {
+		return errors.Join(provider.Shutdown(ctx), dbProvider.Shutdown(ctx))
+	}, nil
+}
+
+// openDB opens the database with a span for every query. Queries only join
+// the caller's trace when they are given the request context.
+func openDB(connectionString, dbName string) (*sql.DB, error) {
+	return otelsql.Open("postgres", connectionString,
+		otelsql.WithTracerProvider(dbTracerProvider),
+		otelsql.WithDBSystem("postgresql"),
+		otelsql.WithDBName(dbName),
+	)
+}
+
+// tracingMiddleware starts a server span for every request, continuing the
+// caller's trace from the HTTP headers or, failing that, the SOAP header.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return soapTraceContext(otelhttp.NewHandler(next, serviceName,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + routeLabel(r)
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return !isProbePath(r.URL.Path)
+		}),
+	))
+}
+
+// soapTraceContext lets SOAP clients that cannot set HTTP headers join a
+// trace: a traceparent and tracestate in the SOAP header are used when the
+// request has no traceparent header. The gateway sends both.
+//
+//	<soap:Header>
+//	  <trace xmlns="http://example.com/trace">
+//	    <traceparent>00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01</traceparent>
+//	  </trace>
+//	</soap:Header>
+func soapTraceContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("traceparent") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		// On a read error handleLoan sees the same error again.
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := soapHeaderPattern.FindString(string(body))
+		if traceparent := extractValue(header, "traceparent"); traceparent != "" {
+			r.Header.Set("traceparent", html.UnescapeString(traceparent))
+			if tracestate := extractValue(header, "tracestate"); tracestate != "" {
+				r.Header.Set("tracestate", html.UnescapeString(tracestate))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider that keeps every finished span.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestSOAPTraceContext(t *testing.T) {
+	recorder := recordSpans(t)
+
+	const envelopeTrace, headerTrace = "4bf92f3577b34da6a3ce929d0e0e4736", "0af7651916cd43dd8448eb211c80319c"
+	envelope := `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/">` +
+		`<soapenv:Header><trace xmlns="http://example.com/trace">` +
+		`<traceparent>00-` + envelopeTrace + `-00f067aa0ba902b7-01</traceparent>` +
+		`<tracestate>vendor=a&amp;b</tracestate>` +
+		`</trace></soapenv:Header><soapenv:Body><getAllLoans/></soapenv:Body></soapenv:Envelope>`
+
+	var body, tracestate string
+	handler := tracingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body, tracestate = string(b), r.Header.Get("tracestate")
+	}))
+
+	tests := []struct {
+		name        string
+		traceparent string
+		want        string
+	}{
+		{"from the SOAP header", "", envelopeTrace},
+		{"HTTP header first", "00-" + headerTrace + "-b7ad6b7169203331-01", headerTrace},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/ws", strings.NewReader(envelope))
+			if tt.traceparent != "" {
+				req.Header.Set("traceparent", tt.traceparent)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if body != envelope {
+				t.Errorf("handler read %q, want the whole envelope", body)
+			}
+			spans := recorder.Ended()
+			if len(spans) != i+1 {
+				t.Fatalf("recorded %d spans", len(spans))
+			}
+			if got := spans[i].SpanContext().TraceID().String(); got != tt.want {
+				t.Errorf("trace = %s, want %s", got, tt.want)
+			}
+			if tt.traceparent == "" && tracestate != "vendor=a&b" {
+				t.Errorf("tracestate = %q, want it unescaped from the envelope", tracestate)
+			}
+		})
+	}
+}
+
+func TestBookServiceTransport(t *testing.T) {
+	recorder := recordSpans(t)
+
+	var traceparent string
+	bookService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer bookService.Close()
+
+	ctx, parent := otel.Tracer("test").Start(t.Context(), "createLoan")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, bookService.URL+"/api/books/1", nil)
+	resp, err := (&http.Client{Transport: bookServiceTransport}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	parent.End()
+
+	call := recorder.Ended()[0]
+	if call.Name() != "book_service GET" || call.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("client span %q with parent %s, want book_service GET under the operation", call.Name(), call.Parent().SpanID())
+	}
+	if !strings.Contains(traceparent, call.SpanContext().SpanID().String()) {
+		t.Errorf("book service got traceparent %q, want the client span", traceparent)
+	}
+}
+
+func TestSetupTracingExporters(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	shutdown, err := setupTracing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(t.Context()); err != nil {
+		t.Errorf("shutdown = %v", err)
+	}
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+	if _, err := setupTracing(); err == nil {
+		t.Error("setupTracing accepted an unknown exporter")
+	}
+}
@@ -2,6 +2,19 @@
 -- This script creates all necessary tables and inserts sample data
 
 -- Drop tables if they exist (for clean re-initialization)
+DROP TABLE IF EXISTS oauth_consents CASCADE;
+DROP TABLE IF EXISTS oauth_auth_codes CASCADE;
+DROP TABLE IF EXISTS api_keys CASCADE;
+DROP TABLE IF EXISTS mfa_recovery_codes CASCADE;
+DROP TABLE IF EXISTS user_mfa CASCADE;
+DROP TABLE IF EXISTS password_reset_tokens CASCADE;
+DROP TABLE IF EXISTS auth_events CASCADE;
+DROP TABLE IF EXISTS login_failures CASCADE;
+DROP TABLE IF EXISTS user_token_revocations CASCADE;
+DROP TABLE IF EXISTS revoked_tokens CASCADE;
+DROP TABLE IF EXISTS sessions CASCADE;
+DROP TABLE IF EXISTS refresh_tokens CASCADE;
+DROP TABLE IF EXISTS oauth_clients CASCADE;
 DROP TABLE IF EXISTS loans CASCADE;
 DROP TABLE IF EXISTS user_credentials CASCADE;
 DROP TABLE IF EXISTS books CASCADE;
@@ -32,10 +45,171 @@ CREATE TABLE user_credentials (
     user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
     username VARCHAR(50) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
+    role VARCHAR(20) NOT NULL DEFAULT 'patron' CHECK (role IN ('patron', 'librarian', 'admin')),
+    auth_source VARCHAR(20) NOT NULL DEFAULT 'local' CHECK (auth_source IN ('local', 'ldap')),
+    email_verified_at TIMESTAMP,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Create OAuth Clients Table
+-- Applications allowed to sign users in through /oauth/authorize or to get
+-- tokens of their own. Public clients have no secret_hash. The list columns are
+-- space-separated.
+CREATE TABLE oauth_clients (
+    client_id VARCHAR(64) PRIMARY KEY,
+    secret_hash VARCHAR(64),
+    name VARCHAR(100) NOT NULL,
+    redirect_uris TEXT NOT NULL DEFAULT '',
+    grant_types TEXT NOT NULL,
+    scopes TEXT NOT NULL,
+    created_by INTEGER REFERENCES user_credentials(user_id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create Refresh Tokens Table
+-- Tokens are single-use: each refresh marks the old row as used and inserts a
+-- new one in the same family. Only SHA-256 hashes of the tokens are stored.
+CREATE TABLE refresh_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_credentials(user_id) ON DELETE CASCADE,
+    family_id VARCHAR(64) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    mfa BOOLEAN NOT NULL DEFAULT FALSE,
+    client_id VARCHAR(64) REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    scope TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create Sessions Table
+-- One row per login. The id is the refresh token family the login started
+-- and is carried in the sid claim of its access tokens.
+CREATE TABLE sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_credentials(user_id) ON DELETE CASCADE,
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    client_ip VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+-- Create Revoked Tokens Table
+-- Individually revoked access tokens, keyed by their jti claim. Rows can be
+-- purged once the token itself has expired.
+CREATE TABLE revoked_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER REFERENCES user_credentials(user_id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    reason VARCHAR(100),
+    revoked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create User Token Revocations Table
+-- Every access token issued to the user before revoked_before is rejected.
+CREATE TABLE user_token_revocations (
+    user_id INTEGER PRIMARY KEY REFERENCES user_credentials(user_id) ON DELETE CASCADE,
+    revoked_before TIMESTAMP NOT NULL
+);
+
+-- Create Login Failures Table
+-- Failed login counters per subject: 'user:<username>' or 'ip:<address>'.
+CREATE TABLE login_failures (
+    subject VARCHAR(120) PRIMARY KEY,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    lockout_count INTEGER NOT NULL DEFAULT 0,
+    locked_until TIMESTAMP,
+    last_failed_at TIMESTAMP
+);
+
+-- Create Auth Events Table
+-- Audit trail of authentication events (logins, lockouts, unlocks...).
+CREATE TABLE auth_events (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(50),
+    client_ip VARCHAR(64),
+    event VARCHAR(40) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create Password Reset Tokens Table
+-- Single-use reset tokens; only SHA-256 hashes are stored.
+CREATE TABLE password_reset_tokens (
+    token_hash VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_credentials(user_id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create User MFA Table
+-- TOTP secret per user. enabled stays FALSE until the first code is confirmed;
+-- last_used_step prevents a code from being replayed.
+CREATE TABLE user_mfa (
+    user_id INTEGER PRIMARY KEY REFERENCES user_credentials(user_id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    enabled_at TIMESTAMP
+);
+
+-- Create MFA Recovery Codes Table
+CREATE TABLE mfa_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_credentials(user_id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP
+);
+
+-- Create API Keys Table
+-- Keys for machine clients. A key acts as its owner (user_id) limited to its
+-- comma-separated scopes. Only the SHA-256 hash of the key is stored.
+CREATE TABLE api_keys (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    key_prefix VARCHAR(16) UNIQUE NOT NULL,
+    key_hash VARCHAR(64) NOT NULL,
+    user_id INTEGER NOT NULL REFERENCES user_credentials(user_id) ON DELETE CASCADE,
+    scopes TEXT NOT NULL,
+    created_by INTEGER REFERENCES user_credentials(user_id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+-- Create OAuth Authorization Codes Table
+-- Single-use codes handed out by /oauth/authorize. family_id links a redeemed
+-- code to the refresh tokens issued for it so a replayed code can revoke them.
+CREATE TABLE oauth_auth_codes (
+    code_hash VARCHAR(64) PRIMARY KEY,
+    client_id VARCHAR(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES user_credentials(user_id) ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    nonce TEXT NOT NULL DEFAULT '',
+    code_challenge VARCHAR(128) NOT NULL,
+    mfa BOOLEAN NOT NULL DEFAULT FALSE,
+    family_id VARCHAR(64),
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Create OAuth Consents Table
+-- The scopes each user last approved for a client.
+CREATE TABLE oauth_consents (
+    user_id INTEGER NOT NULL REFERENCES user_credentials(user_id) ON DELETE CASCADE,
+    client_id VARCHAR(64) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    scope TEXT NOT NULL,
+    granted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, client_id)
+);
+
 -- Create Loans Table
 CREATE TABLE loans (
     id SERIAL PRIMARY KEY,
@@ -54,6 +228,12 @@ CREATE INDEX idx_users_username ON users(username);
 CREATE INDEX idx_loans_user_id ON loans(user_id);
 CREATE INDEX idx_loans_book_id ON loans(book_id);
 CREATE INDEX idx_loans_status ON loans(status);
+CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX idx_revoked_tokens_expires_at ON revoked_tokens(expires_at);
+CREATE INDEX idx_auth_events_username ON auth_events(username);
+CREATE INDEX idx_mfa_recovery_codes_user_id ON mfa_recovery_codes(user_id);
+CREATE INDEX idx_refresh_tokens_client_id ON refresh_tokens(client_id);
+CREATE INDEX idx_sessions_user_id ON sessions(user_id);
 
 -- Insert Sample Users
 INSERT INTO users (username, email, first_name, last_name) VALUES
@@ -61,7 +241,11 @@ INSERT INTO users (username, email, first_name, last_name) VALUES
 ('bob', 'bob@example.com', 'Bob', 'Smith'),
 ('charlie', 'charlie@example.com', 'Charlie', 'Brown'),
 ('david', 'david@example.com', 'David', 'Wilson'),
-('emma', 'emma@example.com', 'Emma', 'Davis');
+('emma', 'emma@example.com', 'Emma', 'Davis'),
+('admin', 'admin@example.com', 'Library', 'Admin');
+
+-- The admin profile gets its credentials from the gateway on first start
+-- (ADMIN_PASSWORD), so no password is stored here.
 
 -- Insert Sample Books
 INSERT INTO books (isbn, title, author, publish_year, category, available_quantity) VALUES
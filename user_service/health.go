@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Health endpoints for orchestration. /healthz only says the process is up;
+// /readyz also checks the dependencies needed to serve requests.
+const (
+	healthzPath        = "/healthz"
+	readyzPath         = "/readyz"
+	healthCheckTimeout = 2 * time.Second
+)
+
+// CheckResult is the outcome of one dependency check. LatencyMs is how long
+// the check took.
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, HealthResponse{Status: "ok"})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, readiness(r.Context(), map[string]func(context.Context) error{
+		"database": db.PingContext,
+	}))
+}
+
+// readiness runs the checks and is ok only if all of them pass.
+func readiness(ctx context.Context, checks map[string]func(context.Context) error) HealthResponse {
+	resp := HealthResponse{Status: "ok", Checks: map[string]CheckResult{}}
+	for name, check := range checks {
+		result := runCheck(ctx, check)
+		if result.Status != "ok" {
+			resp.Status = "unavailable"
+		}
+		resp.Checks[name] = result
+	}
+	return resp
+}
+
+func runCheck(ctx context.Context, check func(context.Context) error) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := check(ctx)
+	result := CheckResult{Status: "ok", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status, result.Error = "unavailable", err.Error()
+	}
+	return result
+}
+
+func writeHealth(w http.ResponseWriter, resp HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if resp.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// isProbePath reports whether path is polled by orchestration or monitoring
+// rather than called by clients.
+func isProbePath(path string) bool {
+	return path == healthzPath || path == readyzPath || path == metricsPath
+}
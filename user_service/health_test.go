@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// pingConnector hands out connections that answer pings, or fails with err.
+type pingConnector struct{ err error }
+
+func (c pingConnector) Connect(context.Context) (driver.Conn, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return pingConn{}, nil
+}
+
+func (c pingConnector) Driver() driver.Driver { return nil }
+
+type pingConn struct{}
+
+func (pingConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (pingConn) Close() error                        { return nil }
+func (pingConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+func (pingConn) Ping(context.Context) error          { return nil }
+
+func TestHandleReadyz(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantCode   int
+		wantStatus string
+	}{
+		{"database up", nil, http.StatusOK, "ok"},
+		{"database down", errors.New("connection refused"), http.StatusServiceUnavailable, "unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db = sql.OpenDB(pingConnector{tt.err})
+			t.Cleanup(func() { db.Close(); db = nil })
+
+			rec := httptest.NewRecorder()
+			handleReadyz(rec, httptest.NewRequest(http.MethodGet, readyzPath, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("GET %s = %d, want %d", readyzPath, rec.Code, tt.wantCode)
+			}
+			if rec.Header().Get("Cache-Control") != "no-store" {
+				t.Error("readiness answers may be cached")
+			}
+			var resp HealthResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			check := resp.Checks["database"]
+			if resp.Status != tt.wantStatus || check.Status != tt.wantStatus {
+				t.Errorf("readiness = %+v, want %s", resp, tt.wantStatus)
+			}
+			if tt.err != nil && check.Error != tt.err.Error() {
+				t.Errorf("database error = %q, want %q", check.Error, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadinessNeedsEveryCheck(t *testing.T) {
+	up := func(context.Context) error { return nil }
+	down := func(context.Context) error { return errors.New("down") }
+	// A check that hangs gives up when the request does.
+	hung := func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }
+
+	if resp := readiness(context.Background(), map[string]func(context.Context) error{"a": up, "b": up}); resp.Status != "ok" {
+		t.Errorf("all checks pass: status %s", resp.Status)
+	}
+	resp := readiness(context.Background(), map[string]func(context.Context) error{"a": up, "b": down})
+	if resp.Status != "unavailable" || resp.Checks["a"].Status != "ok" || resp.Checks["b"].Status != "unavailable" {
+		t.Errorf("one check fails: %+v", resp)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if resp := readiness(ctx, map[string]func(context.Context) error{"a": hung}); resp.Checks["a"].Error != context.Canceled.Error() {
+		t.Errorf("hung check: %+v", resp)
+	}
+}
+
+func TestHealthzAndProbePaths(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleHealthz(rec, httptest.NewRequest(http.MethodGet, healthzPath, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Errorf("GET %s = %d %s", healthzPath, rec.Code, rec.Body)
+	}
+
+	for path, want := range map[string]bool{healthzPath: true, readyzPath: true, metricsPath: true, "/api/users": false, "/healthz/x": false} {
+		if got := isProbePath(path); got != want {
+			t.Errorf("isProbePath(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
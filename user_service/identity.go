@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net/http"
+
+	"identity"
+)
+
+// identitySigningKey is the IDENTITY_SIGNING_KEY shared with the gateway.
+// Without it callers are taken as given but never marked verified.
+var identitySigningKey []byte
+
+// identityMiddleware verifies and logs the caller the gateway forwards, see
+// the identity module. Health probes and metric scrapes pass straight
+// through.
+func identityMiddleware(next http.Handler) http.Handler {
+	return identity.Middleware(identitySigningKey, func(r *http.Request) bool { return isProbePath(r.URL.Path) }, next)
+}
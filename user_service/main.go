@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
+	"identity"
 )
 
 type User struct {
@@ -43,7 +48,12 @@ func main() {
 
 	connectionString := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", dbHost, dbPort, dbUser, dbPassword, dbName)
 
-	db, err = sql.Open("postgres", connectionString)
+	shutdownTracing, err := setupTracing()
+	if err != nil {
+		log.Fatalf("setupTracing error: %v", err)
+	}
+
+	db, err = openDB(connectionString, dbName)
 	if err != nil {
 		log.Fatalf("sql.Open error: %v", err)
 	}
@@ -63,12 +73,18 @@ func main() {
 
 	log.Println("User Service connected to database")
 
+	identitySigningKey = []byte(getEnv("IDENTITY_SIGNING_KEY", ""))
+	registerMetrics(dbName)
+
 	router := mux.NewRouter()
 	router.HandleFunc("/api/users", getAllUsers).Methods("GET")
 	router.HandleFunc("/api/users/{id}", getUserByID).Methods("GET")
 	router.HandleFunc("/api/users", createUser).Methods("POST")
 	router.HandleFunc("/api/users/{id}", updateUser).Methods("PUT")
 	router.HandleFunc("/api/users/{id}", deleteUser).Methods("DELETE")
+	router.HandleFunc(healthzPath, handleHealthz).Methods("GET")
+	router.HandleFunc(readyzPath, handleReadyz).Methods("GET")
+	router.Handle(metricsPath, promhttp.Handler()).Methods("GET")
 
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
@@ -77,10 +93,38 @@ func main() {
         AllowCredentials: true,
 	})
 
-	handler := c.Handler(router)
+	handler := tracingMiddleware(router, metricsMiddleware(router, identityMiddleware(c.Handler(router))))
 
 	log.Println("User Service running on port 8082")
-	log.Fatal(http.ListenAndServe(":8082", handler))
+	serve(&http.Server{Addr: ":8082", Handler: handler}, shutdownTracing)
+}
+
+// shutdownTimeout stays under the 10 seconds docker stop waits before it
+// kills the process.
+const shutdownTimeout = 8 * time.Second
+
+// serve runs server until SIGINT or SIGTERM, then lets the requests in
+// flight finish and flushes the spans not yet exported.
+func serve(server *http.Server, shutdownTracing func(context.Context) error) {
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("server shutdown error: %v", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("tracing shutdown error: %v", err)
+	}
 }
 
 func getEnv(key, defaultValue string) string {
@@ -97,13 +141,13 @@ func getAllUsers(w http.ResponseWriter, r *http.Request) {
 
 	// Get total count
 	var total int
-	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&total)
+	err := db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM users").Scan(&total)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	rows, err := db.Query(`
+	rows, err := db.QueryContext(r.Context(), `
 	SELECT id, username, email, first_name, last_name 
 	FROM users
 	ORDER BY id
@@ -151,7 +195,7 @@ func getUserByID(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var u User
-	err = db.QueryRow("SELECT id, username, email, first_name, last_name FROM users WHERE id = $1", id).Scan(&u.ID, &u.Username, &u.Email, &u.FirstName, &u.LastName)
+	err = db.QueryRowContext(r.Context(), "SELECT id, username, email, first_name, last_name FROM users WHERE id = $1", id).Scan(&u.ID, &u.Username, &u.Email, &u.FirstName, &u.LastName)
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "User not found", http.StatusNotFound)
@@ -178,12 +222,13 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := db.QueryRow("INSERT INTO users (username, email, first_name, last_name) VALUES ($1, $2, $3, $4) RETURNING id", u.Username, u.Email, u.FirstName, u.LastName).Scan(&u.ID)
+	err := db.QueryRowContext(r.Context(), "INSERT INTO users (username, email, first_name, last_name) VALUES ($1, $2, $3, $4) RETURNING id", u.Username, u.Email, u.FirstName, u.LastName).Scan(&u.ID)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("User %d created by %s (request %s)", u.ID, identity.Caller(r), identity.FromRequest(r).RequestID)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -204,7 +249,7 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		return // FIX: Added missing return
 	}
 
-	_, err = db.Exec(
+	_, err = db.ExecContext(r.Context(),
 		"UPDATE users SET username = $1, email = $2, first_name = $3, last_name = $4 WHERE id = $5",
 		u.Username, u.Email, u.FirstName, u.LastName, id,
 	)
@@ -213,6 +258,7 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("User %d updated by %s (request %s)", id, identity.Caller(r), identity.FromRequest(r).RequestID)
 
 	u.ID = id
 	w.Header().Set("Content-Type", "application/json")
@@ -227,11 +273,12 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = db.Exec("DELETE FROM users WHERE id = $1", id)
+	_, err = db.ExecContext(r.Context(), "DELETE FROM users WHERE id = $1", id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	log.Printf("User %d deleted by %s (request %s)", id, identity.Caller(r), identity.FromRequest(r).RequestID)
 
 	w.WriteHeader(http.StatusNoContent)
 }
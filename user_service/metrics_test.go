@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetricsMiddlewareLabels(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "0" {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		// An informational answer first; the final status counts.
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Write([]byte("{}"))
+	}).Methods("GET")
+	handler := metricsMiddleware(router, router)
+
+	for _, path := range []string{"/api/users/1", "/api/users/2", "/api/users/0", "/no/such/page"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest("GET", metricsPath, nil))
+	exposition := rec.Body.String()
+	for _, want := range []string{
+		`http_requests_total{method="GET",route="/api/users/{id}",status="200"} 2`,
+		`http_requests_total{method="GET",route="/api/users/{id}",status="404"} 1`,
+		`http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="/api/users/{id}"} 3`,
+	} {
+		if !strings.Contains(exposition, want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/uptrace/opentelemetry-go-extra/otelsql"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const serviceName = "user_service"
+
+// dbTracerProvider only records database spans that belong to a traced
+// request, so queries run in the background, such as those behind the
+// metrics gauges, do not each start a trace.
+var dbTracerProvider trace.TracerProvider = noop.NewTracerProvider()
+
+// setupTracing installs the tracer provider and the W3C trace context
+// propagator. OTEL_TRACES_EXPORTER chooses where spans go: otlp (to
+// OTEL_EXPORTER_OTLP_ENDPOINT, default http://localhost:4318), stdout, or
+// none (default). Trace context is passed on even when nothing is exported.
+// shutdown flushes the spans still waiting to be exported; call it before
+// exiting.
+func setupTracing() (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	switch name := getEnv("OTEL_TRACES_EXPORTER", "none"); name {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	case "stdout", "console":
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults.
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	spans := sdktrace.NewBatchSpanProcessor(exporter)
+	provider := sdktrace.NewTracerProvider(sdktrace.WithResource(res), sdktrace.WithSpanProcessor(spans))
+	dbProvider := sdktrace.NewTracerProvider(sdktrace.WithResource(res), sdktrace.WithSpanProcessor(spans),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.NeverSample())))
+	otel.SetTracerProvider(provider)
+	dbTracerProvider = dbProvider
+	return func(ctx context.Context) error {
+		return errors.Join(provider.Shutdown(ctx), dbProvider.Shutdown(ctx))
+	}, nil
+}
+
+// openDB opens the database with a span for every query. Queries only join
+// the caller's trace when they are given the request context.
+func openDB(connectionString, dbName string) (*sql.DB, error) {
+	return otelsql.Open("postgres", connectionString,
+		otelsql.WithTracerProvider(dbTracerProvider),
+		otelsql.WithDBSystem("postgresql"),
+		otelsql.WithDBName(dbName),
+	)
+}
+
+// tracingMiddleware starts a server span for every request, continuing the
+// caller's trace. Spans are named after the route of router.
+func tracingMiddleware(router *mux.Router, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, serviceName,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + routeLabel(router, r)
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return !isProbePath(r.URL.Path)
+		}),
+	)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider that keeps every finished span.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestTracingMiddlewareContinuesCallerTrace(t *testing.T) {
+	recorder := recordSpans(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	router.HandleFunc(healthzPath, handleHealthz)
+	handler := tracingMiddleware(router, router)
+
+	const callerTrace, callerSpan = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest(http.MethodGet, "/api/users/1", nil)
+	req.Header.Set("traceparent", "00-"+callerTrace+"-"+callerSpan+"-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, healthzPath, nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want only the request; probes are not traced", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "GET /api/users/{id}" {
+		t.Errorf("span name = %q", span.Name())
+	}
+	// Services sit behind the gateway, so they continue its trace.
+	if span.SpanContext().TraceID().String() != callerTrace || span.Parent().SpanID().String() != callerSpan {
+		t.Errorf("span %s has parent %s, want the caller's", span.SpanContext().TraceID(), span.Parent().SpanID())
+	}
+}
+
+func TestSetupTracingExporters(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	shutdown, err := setupTracing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shutdown(t.Context()); err != nil {
+		t.Errorf("shutdown = %v", err)
+	}
+
+	t.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+	if _, err := setupTracing(); err == nil {
+		t.Error("setupTracing accepted an unknown exporter")
+	}
+}